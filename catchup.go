@@ -0,0 +1,97 @@
+package labbot
+
+import (
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	"github.com/robfig/cron"
+	"go.uber.org/zap"
+)
+
+// Policies for the cron job run which is missed during downtime
+const (
+	catchUpRun  = "run"
+	catchUpSkip = "skip"
+)
+
+// catchUpPolicy returns the policy of the job, --catch-up overrides the default.
+func (l *labbot) catchUpPolicy(job cronJob) string {
+	if policy, ok := l.CatchUp[job.name]; ok {
+		return policy
+	}
+	return job.catchUp
+}
+
+// lastSuccess returns the start time of the last successful run of the job.
+// It returns zero time if the job has never succeeded.
+func (l *labbot) lastSuccess(name string) (time.Time, error) {
+	value, err := l.Redis.HGet(lastSuccessKey, name).Result()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "Could not get the last success")
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// missedRun returns the latest scheduled time after last and until now.
+// It returns zero time if no run is missed.
+func missedRun(schedule cron.Schedule, last, now time.Time) time.Time {
+	var missed time.Time
+	for t := schedule.Next(last); !t.IsZero() && !t.After(now); t = schedule.Next(t) {
+		missed = t
+	}
+	return missed
+}
+
+// catchUpJobs runs once, or records as skipped, the jobs which missed the run
+// within --catch-up-window before now. Jobs which have never succeeded, e.g. added
+// since the last startup or always failing, are checked from the start of the window.
+func (l *labbot) catchUpJobs(now time.Time) {
+	if l.CatchUpWindow <= 0 {
+		return
+	}
+	for _, job := range cronJobs {
+		schedule, err := cron.Parse(job.spec)
+		if err != nil {
+			l.Error("Invalid spec", zap.String("job", job.name), zap.Error(err))
+			continue
+		}
+		last, err := l.lastSuccess(job.name)
+		if err != nil {
+			l.Warn("Failed to catch up cron job", zap.String("job", job.name), zap.Error(err))
+			continue
+		}
+		// Start from the window to avoid walking a long downtime
+		from := last
+		if since := now.Add(-l.CatchUpWindow); from.Before(since) {
+			from = since
+		}
+		missed := missedRun(schedule, from, now)
+		if missed.IsZero() {
+			continue
+		}
+		// The missed run may be already skipped by the previous startup
+		runs, err := l.jobRuns(job.name, 1) // jobs.go
+		if err != nil {
+			l.Warn("Failed to catch up cron job", zap.String("job", job.name), zap.Error(err))
+			continue
+		}
+		if len(runs) > 0 && !runs[0].Start.Before(missed) {
+			continue
+		}
+		switch l.catchUpPolicy(job) {
+		case catchUpRun:
+			l.Info("catch up cron job", zap.String("job", job.name), zap.Time("missed", missed))
+			l.runJobOnce(job, true) // jobs.go
+		default:
+			l.Info("skip missed cron job", zap.String("job", job.name), zap.Time("missed", missed))
+			run := &jobRun{Job: job.name, Start: missed, End: now, Outcome: outcomeSkipped, CatchUp: true}
+			if err := l.recordJobRun(run); err != nil {
+				l.Warn("Failed to record cron job", zap.String("job", job.name), zap.Error(err))
+			}
+		}
+	}
+}
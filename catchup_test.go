@@ -0,0 +1,35 @@
+package labbot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/labbot/internal/testserver"
+)
+
+func TestCatchUpJobsNeverSucceeded(t *testing.T) {
+	slack := testserver.NewSlack()
+	defer slack.Close()
+	line := testserver.NewLINE()
+	defer line.Close()
+	l, _ := newTestLabbot(t, slack, line)
+	l.CatchUpWindow = 3 * time.Hour
+
+	// progress has no last success, e.g. it is added since the last startup
+	now := time.Date(2026, 10, 20, 19, 0, 0, 0, jst)
+	l.catchUpJobs(now)
+	runs, err := l.jobRuns("progress", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2026, 10, 20, 18, 30, 0, 0, jst)
+	if len(runs) != 1 || runs[0].Outcome != outcomeSkipped || !runs[0].Start.Equal(want) {
+		t.Fatalf("runs = %+v, want the run at %s skipped", runs, want)
+	}
+
+	// The missed run is skipped only once
+	l.catchUpJobs(now.Add(time.Minute))
+	if runs, _ := l.jobRuns("progress", maxJobRuns); len(runs) != 1 {
+		t.Errorf("runs = %d, want 1", len(runs))
+	}
+}
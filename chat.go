@@ -0,0 +1,280 @@
+package labbot
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// ChatAdapter is the chat platform which the bot talks on, such as slack.
+type ChatAdapter interface {
+	// Name returns the name of platform, it is used in logs.
+	Name() string
+	// PostMessage posts the message to the channel.
+	PostMessage(channelID string, msg *ChatMessage) error
+	// FindUserID returns the id of user who has the name.
+	FindUserID(name string) (string, error)
+	// FindChannelID returns the id of channel which has the name.
+	FindChannelID(name string) (string, error)
+	// DirectChannelID returns the id of channel to send direct messages to the user.
+	DirectChannelID(userID string) (string, error)
+	// User returns the user who has the id.
+	User(userID string) (*ChatUser, error)
+	// RegisterHandlers registers webhooks from the platform, e.g. buttons, slash commands.
+	RegisterHandlers(mux *http.ServeMux, h ChatHandler)
+	// Listen receives mentions to the bot until the connection is closed.
+	Listen(h ChatHandler) error
+	// Ping checks the credentials and the connection to the platform.
+	Ping() error
+	// Connected reports whether mentions can be received.
+	Connected() bool
+	// Close closes the connection which is opened by Listen.
+	Close() error
+}
+
+// ChatHandler handles events from ChatAdapter, it is implemented by labbot.
+type ChatHandler interface {
+	// OnMention is called when the bot is mentioned or received a direct message.
+	OnMention(m *Mention)
+	// OnChoice is called when the choice is selected, and returns the result title.
+	OnChoice(c *ChoiceEvent) string
+	// OnCommand is called by slash command like "/labbot in", and returns the reply.
+	OnCommand(userID, text string) string
+}
+
+// ChatMessage is a message which is posted to chat platform
+type ChatMessage struct {
+	Text       string
+	Attachment *ChatAttachment
+}
+
+// ChatAttachment is a decorated part of message, which may have choices
+type ChatAttachment struct {
+	Text       string
+	Color      string
+	Footer     string
+	CallbackID string
+	Choices    []Choice
+}
+
+// Choice is a button in the attachment
+type Choice struct {
+	Name  string
+	Text  string
+	Value string
+	Style string // "primary", "danger" or ""
+}
+
+// ChatUser is a user on chat platform
+type ChatUser struct {
+	ID          string
+	Name        string
+	DisplayName string
+}
+
+// Mention is a message which mentions the bot
+type Mention struct {
+	Channel string
+	User    string
+	// Text is the message without the mention to the bot
+	Text   string
+	Direct bool
+}
+
+// ChoiceEvent is sent when a user selects the choice
+type ChoiceEvent struct {
+	CallbackID string
+	Name       string
+	Value      string
+	UserID     string
+}
+
+const (
+	actionJoin    = "参加"
+	actionNotJoin = "参加しない"
+	actionApprove = "承認"
+	actionReject  = "却下"
+)
+
+// Labels of choices are in --locale, the name is the action which doesn't depend on the locale.
+func (l *labbot) joinMessage(text string) *ChatMessage {
+	return &ChatMessage{
+		Attachment: &ChatAttachment{
+			Text:       text,
+			Color:      "#27ae60",
+			CallbackID: "participation",
+			Choices: []Choice{
+				{Name: actionJoin, Text: l.message("choice.join", &messageData{}), Value: "join"},
+				{Name: actionNotJoin, Text: l.message("choice.not-join", &messageData{}), Style: "danger", Value: "not join"},
+			},
+		},
+	}
+}
+
+func (l *labbot) approveMessage(locale, text, id string) *ChatMessage {
+	return &ChatMessage{
+		Attachment: &ChatAttachment{
+			Text:       text,
+			Color:      "#8e44ad",
+			CallbackID: "backdate",
+			Choices: []Choice{
+				{Name: actionApprove, Text: l.messageIn(locale, "choice.approve", &messageData{}), Style: "primary", Value: id},
+				{Name: actionReject, Text: l.messageIn(locale, "choice.reject", &messageData{}), Style: "danger", Value: id},
+			},
+		},
+	}
+}
+
+// OnMention implements ChatHandler
+func (l *labbot) OnMention(m *Mention) {
+	l.work.Add(1) // wait on shutdown
+	defer l.work.Done()
+
+	reply := func(text string) {
+		l.post(m.Channel, &ChatMessage{Text: text})
+	}
+
+	// 誰がいる?, 今週の時間, ゼミいつ?
+	req := &commandRequest{
+		Text:   m.Text,
+		UserID: m.User,
+		member: func() (string, error) {
+			return l.memberName(m.User)
+		},
+	}
+	// 誰か来たら教えて, and 昨日の15時に誰がいた? are answered before 誰がいる?
+	if text, ok := l.answerSubscription(m.User, m.Text); ok { // subscription.go
+		reply(text)
+	} else if text, ok := l.answerTimeQuery(req); ok { // timequery.go
+		reply(text)
+	} else if text, ok := l.answer(commands, req); ok {
+		reply(text)
+	}
+
+	// よし
+	if strings.Contains(m.Text, "よし") {
+		l.post(m.Channel, l.joinMessage(m.Text))
+	}
+
+	// in, out, iam
+	args := strings.Fields(m.Text)
+	if len(args) == 0 {
+		return
+	}
+	switch args[0] {
+	case "in", "out":
+		reply(l.checkManually(m.User, args))
+	case "iam":
+		if len(args) < 2 {
+			reply(l.messageIn(l.localeOfChatUser(m.User), "usage.iam", &messageData{}))
+			return
+		}
+		reply(l.linkMember(m.User, strings.Join(args[1:], " ")))
+	case "pin":
+		if !m.Direct || len(args) < 2 {
+			reply(l.messageIn(l.localeOfChatUser(m.User), "usage.pin", &messageData{}))
+			return
+		}
+		reply(l.setPin(m.User, args[1]))
+	case "qr":
+		if !m.Direct {
+			reply(l.messageIn(l.localeOfChatUser(m.User), "usage.qr", &messageData{}))
+			return
+		}
+		reply(l.kioskToken(m.User))
+	case "members":
+		reply(l.membersMessage(m.User))
+	case "jobs":
+		reply(l.jobsMessage(l.localeOfChatUser(m.User))) // jobs.go
+	case "lang":
+		reply(l.setChatLocale(m.User, args)) // locale.go
+	case "mac":
+		if len(args) < 2 {
+			reply(l.messageIn(l.localeOfChatUser(m.User), "usage.mac", &messageData{}))
+			return
+		}
+		reply(l.registerDevice(m.User, args[1]))
+	}
+}
+
+// OnChoice implements ChatHandler
+func (l *labbot) OnChoice(c *ChoiceEvent) string {
+	switch c.Name {
+	case actionJoin:
+		return l.messageIn(l.localeOfChatUser(c.UserID), "reply.join", &messageData{})
+	case actionNotJoin:
+		return l.messageIn(l.localeOfChatUser(c.UserID), "reply.not-join", &messageData{})
+	case actionApprove:
+		return l.decideApproval(c.UserID, c.Value, true) // checkin.go
+	case actionReject:
+		return l.decideApproval(c.UserID, c.Value, false)
+	case actionLastOut:
+		return l.ackLastOut(c.Value, l.localeOfChatUser(c.UserID)) // lastout.go
+	}
+	l.Error("Invalid action was submitted", zap.String("action", c.Name))
+	return ""
+}
+
+// OnCommand implements ChatHandler
+func (l *labbot) OnCommand(userID, text string) string {
+	args := strings.Fields(text)
+	if len(args) > 0 {
+		switch args[0] {
+		case "in", "out":
+			return l.checkManually(userID, args)
+		case "pin":
+			if len(args) > 1 {
+				return l.setPin(userID, args[1])
+			}
+		case "qr":
+			return l.kioskToken(userID)
+		case "mac":
+			if len(args) > 1 {
+				return l.registerDevice(userID, args[1])
+			}
+		}
+	}
+	return l.messageIn(l.localeOfChatUser(userID), "usage.command", &messageData{})
+}
+
+// postToChat posts the message to the channel which has the name.
+func (l *labbot) postToChat(channel, msg string) error {
+	channelID, err := l.Chat.FindChannelID(channel)
+	if err != nil {
+		return errors.Wrap(err, "Failed to find channel id")
+	}
+	if err := l.Chat.PostMessage(channelID, &ChatMessage{Text: msg}); err != nil {
+		return errors.Wrapf(err, "Failed to post message to %s", channel)
+	}
+	l.Info("Message successfully sent", zap.String("chat", l.Chat.Name()), zap.String("channel", channel))
+	return nil
+}
+
+func (l *labbot) sendDirectMessage(userID string, msg *ChatMessage) {
+	channelID, err := l.Chat.DirectChannelID(userID)
+	if err != nil {
+		l.Warn("Failed to open direct message channel", zap.Error(err), zap.String("user", userID))
+		return
+	}
+	l.post(channelID, msg)
+}
+
+func (l *labbot) post(channelID string, msg *ChatMessage) {
+	if err := l.Chat.PostMessage(channelID, msg); err != nil {
+		l.Warn(
+			"Failed to post message",
+			zap.String("chat", l.Chat.Name()),
+			zap.String("channelID", channelID),
+			zap.String("message", msg.Text),
+			zap.Error(err),
+		)
+		return
+	}
+	l.Info(
+		"Message successfully sent",
+		zap.String("chat", l.Chat.Name()),
+		zap.String("channelID", channelID),
+	)
+}
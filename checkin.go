@@ -0,0 +1,339 @@
+package labbot
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	slackMembersKey = key + ":slack_members"
+	approvalKey     = key + ":approval"
+)
+
+// manualCheck is parsed "in" or "out" command
+type manualCheck struct {
+	Inlab     bool
+	At        time.Time
+	Backdated bool
+}
+
+// parseManualCheck parses arguments like "in", "out", "in --at 09:30".
+// The time of --at is yesterday if it's later than now, e.g. "out --at 23:30" after midnight,
+// and it must not be before last, the time of the last record like the arrival.
+// Errors are messageError which is shown to the user.
+func parseManualCheck(args []string, now, last time.Time) (*manualCheck, error) {
+	if len(args) == 0 {
+		return nil, newMessageError("check.usage", &messageData{})
+	}
+	check := &manualCheck{At: now}
+	switch args[0] {
+	case "in":
+		check.Inlab = true
+	case "out":
+		check.Inlab = false
+	default:
+		return nil, newMessageError("check.unknown", &messageData{Value: args[0]})
+	}
+	for i := 1; i < len(args); i++ {
+		switch args[i] {
+		case "--at":
+			if i+1 >= len(args) {
+				return nil, newMessageError("check.no-time", &messageData{})
+			}
+			t, err := time.ParseInLocation("15:04", args[i+1], now.Location())
+			if err != nil {
+				return nil, newMessageError("check.invalid-time", &messageData{Value: args[i+1]})
+			}
+			at := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+			if at.After(now) {
+				at = at.AddDate(0, 0, -1)
+			}
+			if at.Before(last) {
+				return nil, newMessageError("check.before-last", &messageData{Value: args[i+1]})
+			}
+			check.At = at
+			check.Backdated = true
+			i++
+		default:
+			return nil, newMessageError("check.unknown-option", &messageData{Value: args[i]})
+		}
+	}
+	return check, nil
+}
+
+// memberName returns the lab member name linked with the chat user.
+// If not linked by "iam" command, display name on chat is used.
+func (l *labbot) memberName(userID string) (string, error) {
+	name, err := l.Redis.HGet(slackMembersKey, userID).Result()
+	if err == nil {
+		return name, nil
+	}
+	if err != redis.Nil {
+		return "", errors.Wrap(err, "Failed to get linked member name")
+	}
+	user, err := l.Chat.User(userID)
+	if err != nil {
+		return "", err
+	}
+	if user.DisplayName != "" {
+		return user.DisplayName, nil
+	}
+	return user.Name, nil
+}
+
+// linkMember links the chat user with the name which is used on LINE.
+// The name which is linked with another user is relinked only by administrators,
+// or asked to them, so that nobody can check in as others.
+// The reply is in the locale of the member who is linked now.
+func (l *labbot) linkMember(userID, name string) string {
+	locale := l.localeOfChatUser(userID) // locale.go
+	linked, err := l.linkedUsers(name)
+	if err != nil {
+		l.Error("Could not get linked users", zap.Error(err))
+		return l.messageIn(locale, "link.failed", &messageData{})
+	}
+	if linkedWithOthers(linked, userID) && !l.isAdmin(userID) {
+		if err := l.requestLink(userID, name); err != nil {
+			l.Error("Failed to request approval", zap.Error(err))
+			return l.messageIn(locale, "approval.request-failed", &messageData{})
+		}
+		return l.messageIn(locale, "link.requested", &messageData{Name: name})
+	}
+	if err := l.link(userID, name, linked); err != nil {
+		l.Error("Could not link member", zap.Error(err))
+		return l.messageIn(locale, "link.failed", &messageData{})
+	}
+	return l.messageIn(l.localeOf(name), "link.done", &messageData{Name: name})
+}
+
+// linkedUsers returns chat users who are linked with the name.
+func (l *labbot) linkedUsers(name string) ([]string, error) {
+	links, err := l.Redis.HGetAll(slackMembersKey).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get linked members")
+	}
+	var users []string
+	for userID, linked := range links {
+		if linked == name {
+			users = append(users, userID)
+		}
+	}
+	return users, nil
+}
+
+func linkedWithOthers(linked []string, userID string) bool {
+	for _, other := range linked {
+		if other != userID {
+			return true
+		}
+	}
+	return false
+}
+
+// link links the chat user with the name, and unlinks others who were linked with it.
+func (l *labbot) link(userID, name string, linked []string) error {
+	_, err := l.Redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, other := range linked {
+			if other != userID {
+				pipe.HDel(slackMembersKey, other)
+			}
+		}
+		pipe.HSet(slackMembersKey, userID, name)
+		return nil
+	})
+	return errors.Wrap(err, "Could not link member")
+}
+
+func (l *labbot) isAdmin(userID string) bool {
+	user, err := l.Chat.User(userID)
+	if err != nil {
+		l.Warn("Failed to get user info", zap.Error(err))
+		return false
+	}
+	for _, admin := range l.Admins {
+		if admin == user.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkManually handles "in" and "out" command from chat user,
+// and returns reply message.
+func (l *labbot) checkManually(userID string, args []string) string {
+	locale := l.localeOfChatUser(userID) // locale.go
+	name, err := l.memberName(userID)
+	if err != nil {
+		l.Error("Could not find member name", zap.Error(err))
+		return l.messageIn(locale, "member.unknown", &messageData{})
+	}
+	check, err := parseManualCheck(args, time.Now(), lastUpdate(name)) // line-beacon.go
+	if err != nil {
+		return l.errorMessage(locale, err, "check.usage") // persona.go
+	}
+	if check.Backdated && l.ApproveBackdate && !l.isAdmin(userID) {
+		if err := l.requestApproval(userID, name, check); err != nil {
+			l.Error("Failed to request approval", zap.Error(err))
+			return l.messageIn(locale, "approval.request-failed", &messageData{})
+		}
+		return l.messageIn(locale, "approval.requested", &messageData{})
+	}
+	return l.recordPresence(name, check.Inlab, check.At, sourceManual)
+}
+
+// recordPresence records presence change through the same path as beacon,
+// and returns reply message.
+func (l *labbot) recordPresence(name string, inlab bool, at time.Time, src source) string {
+	locale := l.localeOf(name) // locale.go
+	if isAlready(name) == inlab {
+		if inlab {
+			return l.messageIn(locale, "check.already-in", &messageData{Name: name})
+		}
+		return l.messageIn(locale, "check.not-in", &messageData{Name: name})
+	}
+	channelID, err := l.Chat.FindChannelID("timestamp")
+	if err != nil {
+		l.Warn("Failed to find channel id", zap.Error(err))
+		return l.messageIn(locale, "check.failed", &messageData{})
+	}
+	var reply string
+	if inlab {
+		reply = l.greeting(locale, name, at)
+		l.welcomeToLab(name, l.DefaultRoom, channelID, at, src)
+	} else {
+		reply = l.getMessageWorkingTime(locale, name, at)
+		l.seeyouFromLab(name, channelID, at, src)
+	}
+	l.storePeopleData()
+	return reply
+}
+
+// approvalLink is Kind of approval to relink the name with another chat user
+const approvalLink = "link"
+
+// approval is a backdated check or a link which is waiting for approval of administrators
+type approval struct {
+	// Kind is empty for the backdated check, or approvalLink
+	Kind   string    `json:"kind,omitempty"`
+	UserID string    `json:"user_id"`
+	Name   string    `json:"name"`
+	Inlab  bool      `json:"in_lab"`
+	At     time.Time `json:"at"`
+}
+
+func (l *labbot) requestApproval(userID, name string, check *manualCheck) error {
+	requested := "approval.out"
+	if check.Inlab {
+		requested = "approval.in"
+	}
+	req := &approval{
+		UserID: userID,
+		Name:   name,
+		Inlab:  check.Inlab,
+		At:     check.At,
+	}
+	return l.askAdmins(req, func(locale string) string {
+		return l.messageIn(locale, requested, &messageData{Name: name, Time: formatTime(locale, check.At)})
+	})
+}
+
+func (l *labbot) requestLink(userID, name string) error {
+	requester := userID
+	if user, err := l.Chat.User(userID); err == nil {
+		requester = user.Name
+	}
+	req := &approval{Kind: approvalLink, UserID: userID, Name: name}
+	return l.askAdmins(req, func(locale string) string {
+		return l.messageIn(locale, "link.request", &messageData{Name: name, Value: requester})
+	})
+}
+
+// askAdmins stores the request, and sends it to administrators in their locale.
+func (l *labbot) askAdmins(req *approval, text func(locale string) string) error {
+	serialized, err := json.Marshal(req)
+	if err != nil {
+		return errors.Wrap(err, "JSON Marshal error")
+	}
+	id := strconv.FormatInt(time.Now().UnixNano(), 36)
+	if err := l.Redis.HSet(approvalKey, id, string(serialized)).Err(); err != nil {
+		return errors.Wrap(err, "Could not set approval to redis")
+	}
+	for _, admin := range l.Admins {
+		adminID, err := l.Chat.FindUserID(admin)
+		if err != nil {
+			l.Warn("Failed to find admin", zap.Error(err))
+			continue
+		}
+		locale := l.localeOfChatUser(adminID)
+		l.sendDirectMessage(adminID, l.approveMessage(locale, text(locale), id)) // chat.go
+	}
+	return nil
+}
+
+// decideApproval approves or rejects the backdated check by the administrator,
+// and returns the result title.
+// The result is in the locale of the administrator, and the requester is told in theirs.
+func (l *labbot) decideApproval(userID, id string, approved bool) string {
+	locale := l.localeOfChatUser(userID)
+	if !l.isAdmin(userID) {
+		l.Warn("Approval by non-administrator", zap.String("user", userID), zap.String("id", id))
+		return l.messageIn(locale, "approval.admin-only", &messageData{})
+	}
+	serialized, err := l.Redis.HGet(approvalKey, id).Result()
+	if err != nil {
+		l.Warn("Could not get approval", zap.String("id", id), zap.Error(err))
+		return l.messageIn(locale, "approval.handled", &messageData{})
+	}
+	// Only one who removes it decides, in case both buttons are pressed at once
+	n, err := l.Redis.HDel(approvalKey, id).Result()
+	if err != nil {
+		l.Error("Could not remove approval", zap.String("id", id), zap.Error(err))
+		return l.messageIn(locale, "approval.failed", &messageData{})
+	}
+	if n == 0 {
+		return l.messageIn(locale, "approval.handled", &messageData{})
+	}
+
+	var req approval
+	if err := json.Unmarshal([]byte(serialized), &req); err != nil {
+		l.Error("Could not unmarshal json", zap.Error(err))
+		return l.messageIn(locale, "approval.failed", &messageData{})
+	}
+	if req.Kind == approvalLink {
+		return l.decideLink(locale, &req, approved)
+	}
+	requester := l.localeOf(req.Name)
+	data := &messageData{Name: req.Name, Time: formatTime(requester, req.At)}
+	if !approved {
+		l.sendDirectMessage(req.UserID, &ChatMessage{Text: l.messageIn(requester, "approval.rejected", data)})
+		return l.messageIn(locale, "approval.reject", &messageData{})
+	}
+	reply := l.recordPresence(req.Name, req.Inlab, req.At, sourceManual)
+	l.sendDirectMessage(req.UserID, &ChatMessage{Text: l.messageIn(requester, "approval.approved", data) + "\n" + reply})
+	return l.messageIn(locale, "approval.approve", &messageData{})
+}
+
+// decideLink links the name with the requester if it's approved.
+func (l *labbot) decideLink(locale string, req *approval, approved bool) string {
+	data := &messageData{Name: req.Name}
+	if !approved {
+		requester := l.localeOfChatUser(req.UserID)
+		l.sendDirectMessage(req.UserID, &ChatMessage{Text: l.messageIn(requester, "link.rejected", data)})
+		return l.messageIn(locale, "approval.reject", &messageData{})
+	}
+	linked, err := l.linkedUsers(req.Name)
+	if err == nil {
+		err = l.link(req.UserID, req.Name, linked)
+	}
+	if err != nil {
+		l.Error("Could not link member", zap.Error(err))
+		return l.messageIn(locale, "approval.failed", &messageData{})
+	}
+	l.sendDirectMessage(req.UserID, &ChatMessage{Text: l.messageIn(l.localeOf(req.Name), "link.done", data)})
+	return l.messageIn(locale, "approval.approve", &messageData{})
+}
@@ -0,0 +1,92 @@
+package labbot
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/labbot/internal/testserver"
+)
+
+func TestParseManualCheck(t *testing.T) {
+	// checkNow is 00:30 after midnight, and the member came at 21:00 yesterday
+	checkNow := time.Date(2026, 10, 21, 0, 30, 0, 0, jst)
+	came := time.Date(2026, 10, 20, 21, 0, 0, 0, jst)
+	tests := []struct {
+		args  string
+		last  time.Time
+		want  *manualCheck
+		error string // id of messageError
+	}{
+		{"in", time.Time{}, &manualCheck{Inlab: true, At: checkNow}, ""},
+		{"out", came, &manualCheck{Inlab: false, At: checkNow}, ""},
+		{"in --at 00:10", time.Time{}, &manualCheck{Inlab: true, At: time.Date(2026, 10, 21, 0, 10, 0, 0, jst), Backdated: true}, ""},
+		{"in --at 00:30", time.Time{}, &manualCheck{Inlab: true, At: checkNow, Backdated: true}, ""},
+		// Later than now is yesterday
+		{"out --at 23:30", came, &manualCheck{Inlab: false, At: time.Date(2026, 10, 20, 23, 30, 0, 0, jst), Backdated: true}, ""},
+		{"out --at 21:00", came, &manualCheck{Inlab: false, At: came, Backdated: true}, ""},
+		// Leaving before the arrival makes negative working time
+		{"out --at 20:59", came, nil, "check.before-last"},
+		{"out --at 00:40", came, nil, "check.before-last"},
+		{"", time.Time{}, nil, "check.usage"},
+		{"stay", time.Time{}, nil, "check.unknown"},
+		{"in --at", time.Time{}, nil, "check.no-time"},
+		{"in --at 25:00", time.Time{}, nil, "check.invalid-time"},
+		{"in --now", time.Time{}, nil, "check.unknown-option"},
+	}
+	for _, tt := range tests {
+		got, err := parseManualCheck(strings.Fields(tt.args), checkNow, tt.last)
+		if tt.error != "" {
+			if e, ok := err.(*messageError); !ok || e.id != tt.error {
+				t.Errorf("parseManualCheck(%q) = %+v, %v, want %s", tt.args, got, err, tt.error)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseManualCheck(%q) = %v", tt.args, err)
+			continue
+		}
+		if got.Inlab != tt.want.Inlab || !got.At.Equal(tt.want.At) || got.Backdated != tt.want.Backdated {
+			t.Errorf("parseManualCheck(%q) = %+v, want %+v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestLinkMemberOfOthers(t *testing.T) {
+	slack := testserver.NewSlack()
+	defer slack.Close()
+	slack.AddUser("UALICE", "alice", "ありす")
+	slack.AddUser("UMALLORY", "mallory", "まろりー")
+	slack.AddUser("UADMIN", "admin", "先生")
+	line := testserver.NewLINE()
+	defer line.Close()
+	l, _ := newTestLabbot(t, slack, line)
+	l.Admins = []string{"admin"}
+
+	l.linkMember("UALICE", "ありす")
+	if got := l.linkMember("UMALLORY", "ありす"); got != l.message("link.requested", &messageData{Name: "ありす"}) {
+		t.Errorf("reply = %q, want the request to administrators", got)
+	}
+	if name, _ := l.memberName("UMALLORY"); name == "ありす" {
+		t.Fatal("ありす is taken over without approval")
+	}
+	if name, _ := l.memberName("UALICE"); name != "ありす" {
+		t.Errorf("memberName(UALICE) = %q, want ありす", name)
+	}
+
+	ids, err := l.Redis.HKeys(approvalKey).Result()
+	if err != nil || len(ids) != 1 {
+		t.Fatalf("approvals = %v, %v", ids, err)
+	}
+	if got := l.decideApproval("UMALLORY", ids[0], true); got != l.message("approval.admin-only", &messageData{}) {
+		t.Errorf("approval by the requester = %q", got)
+	}
+	l.decideApproval("UADMIN", ids[0], true)
+	if name, _ := l.memberName("UMALLORY"); name != "ありす" {
+		t.Errorf("memberName(UMALLORY) = %q after approval, want ありす", name)
+	}
+	// The name is linked with only one user
+	if linked, _ := l.linkedUsers("ありす"); len(linked) != 1 || linked[0] != "UMALLORY" {
+		t.Errorf("users linked with ありす = %v, want [UMALLORY]", linked)
+	}
+}
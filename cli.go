@@ -0,0 +1,255 @@
+package labbot
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Code-Hex/exit"
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	"github.com/robfig/cron"
+)
+
+// runCommand runs the subcommand except "serve" and "simulate".
+// Subcommands share options and the storage with the server.
+func (l *labbot) runCommand(args []string) error {
+	if err := l.setup(); err != nil {
+		return err
+	}
+	switch l.command {
+	case "send":
+		return l.sendCommand()
+	case "cron list":
+		return listCronJobs(os.Stdout, time.Now())
+	case "cron next":
+		return nextCronJobs(os.Stdout, time.Now(), l.CronCommand.Next.Count)
+	case "presence show":
+		return l.showPresence(os.Stdout)
+	case "presence reset":
+		return l.resetPresence(args)
+	case "export attendance":
+		return l.exportAttendance()
+	}
+	return exit.MakeUsage(errors.Errorf("unknown command %q", l.command))
+}
+
+// sendCommand posts the one-off announcement.
+func (l *labbot) sendCommand() error {
+	opts := l.SendCommand
+	l.Chat = l.newChatAdapter()
+	if err := l.postToChat(opts.Channel, opts.Text); err != nil { // chat.go
+		return exit.MakeUnAvailable(err)
+	}
+	if opts.LINE {
+		bot, err := l.newLINEClient() // line-client.go
+		if err != nil {
+			return exit.MakeSoftWare(err)
+		}
+		l.LINE = bot
+		if err := l.multicastToLINE(stripSlackMarkup(opts.Text)); err != nil { // line.go
+			return exit.MakeUnAvailable(err)
+		}
+	}
+	return nil
+}
+
+// listCronJobs writes scheduled jobs and the next time of them.
+func listCronJobs(w io.Writer, now time.Time) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSPEC\tNEXT")
+	for _, job := range cronJobs {
+		schedule, err := cron.Parse(job.spec)
+		if err != nil {
+			return exit.MakeSoftWare(errors.Wrapf(err, "Invalid spec of %s", job.name))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", job.name, job.spec, schedule.Next(now).Format(tmformat))
+	}
+	return tw.Flush()
+}
+
+// nextCronJobs writes upcoming count job times in order.
+func nextCronJobs(w io.Writer, now time.Time, count int) error {
+	type run struct {
+		name string
+		at   time.Time
+	}
+	var runs []run
+	for _, job := range cronJobs {
+		schedule, err := cron.Parse(job.spec)
+		if err != nil {
+			return exit.MakeSoftWare(errors.Wrapf(err, "Invalid spec of %s", job.name))
+		}
+		// Each job runs at most count times in the upcoming count runs
+		at := now
+		for i := 0; i < count; i++ {
+			at = schedule.Next(at)
+			runs = append(runs, run{name: job.name, at: at})
+		}
+	}
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[i].at.Before(runs[j].at)
+	})
+	if len(runs) > count {
+		runs = runs[:count]
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, r := range runs {
+		fmt.Fprintf(tw, "%s\t%s\n", r.at.Format(tmformat), r.name)
+	}
+	return tw.Flush()
+}
+
+// loadPresence reads the presence which is stored by the server.
+func (l *labbot) loadPresence() (map[string]*Person, error) {
+	people := make(map[string]*Person)
+	serialized, err := l.Redis.Get(key).Result()
+	if err == redis.Nil {
+		return people, nil
+	}
+	if err != nil {
+		return nil, exit.MakeUnAvailable(errors.Wrap(err, "Could not get the presence"))
+	}
+	if err := json.Unmarshal([]byte(serialized), &people); err != nil {
+		return nil, exit.MakeDataErr(errors.Wrap(err, "Could not unmarshal the presence"))
+	}
+	return people, nil
+}
+
+func (l *labbot) showPresence(w io.Writer) error {
+	people, err := l.loadPresence()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(people))
+	for name := range people {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATUS\tROOM\tUPDATED")
+	for _, name := range names {
+		person := people[name]
+		status := "out"
+		if person.Inlab {
+			status = "in"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", name, status, person.Room, time.Time(person.UpdateTime).Format(tmformat))
+	}
+	return tw.Flush()
+}
+
+// resetPresence removes the presence of names, or everyone with --all.
+// Running servers keep the presence in memory, so they are told to forget it
+// through presenceResetChannel. Otherwise they would write it back.
+func (l *labbot) resetPresence(names []string) error {
+	if l.PresenceCommand.Reset.All {
+		if err := l.Redis.Del(key).Err(); err != nil {
+			return exit.MakeUnAvailable(errors.Wrap(err, "Could not reset the presence"))
+		}
+		return l.publishPresenceReset(&presenceReset{All: true})
+	}
+	if len(names) == 0 {
+		return exit.MakeUsage(errors.New("specify names to reset, or --all"))
+	}
+	people, err := l.loadPresence()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, ok := people[name]; !ok {
+			return exit.MakeDataErr(errors.Errorf("%s is not found in the presence", name))
+		}
+		delete(people, name)
+	}
+	serialized, err := json.Marshal(people)
+	if err != nil {
+		return exit.MakeSoftWare(errors.Wrap(err, "JSON Marshal error"))
+	}
+	if err := l.Redis.Set(key, string(serialized), 0).Err(); err != nil {
+		return exit.MakeUnAvailable(errors.Wrap(err, "Could not set the presence"))
+	}
+	return l.publishPresenceReset(&presenceReset{Names: names})
+}
+
+func (l *labbot) publishPresenceReset(reset *presenceReset) error {
+	serialized, err := json.Marshal(reset)
+	if err != nil {
+		return exit.MakeSoftWare(errors.Wrap(err, "JSON Marshal error"))
+	}
+	if err := l.Redis.Publish(presenceResetChannel, string(serialized)).Err(); err != nil {
+		return exit.MakeUnAvailable(errors.Wrap(err, "Could not tell the reset to servers"))
+	}
+	return nil
+}
+
+// exportAttendance writes the history between --since and --until as CSV.
+func (l *labbot) exportAttendance() error {
+	opts := l.ExportCommand.Attendance
+	now := time.Now()
+	y, m, _ := now.Date()
+	since := time.Date(y, m, 1, 0, 0, 0, 0, time.Local)
+	until := now
+	if opts.Since != "" {
+		t, err := time.ParseInLocation("2006-01-02", opts.Since, time.Local)
+		if err != nil {
+			return exit.MakeUsage(errors.Wrap(err, "Invalid --since"))
+		}
+		since = t
+	}
+	if opts.Until != "" {
+		t, err := time.ParseInLocation("2006-01-02", opts.Until, time.Local)
+		if err != nil {
+			return exit.MakeUsage(errors.Wrap(err, "Invalid --until"))
+		}
+		until = t.AddDate(0, 0, 1) // until the end of the day
+	}
+
+	records, err := l.history(since) // history.go
+	if err != nil {
+		return exit.MakeUnAvailable(errors.Wrap(err, "Could not get the history"))
+	}
+
+	var w io.Writer = os.Stdout
+	if opts.Output != "" {
+		f, err := os.Create(opts.Output)
+		if err != nil {
+			return exit.MakeCantCreat(errors.Wrap(err, "Failed to create output"))
+		}
+		defer f.Close()
+		w = f
+	}
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"date", "time", "name", "status", "room", "from", "source"})
+	for _, record := range records {
+		if !record.Time.Before(until) {
+			break
+		}
+		status := "out"
+		if record.From != "" {
+			status = "move"
+		} else if record.Inlab {
+			status = "in"
+		}
+		cw.Write([]string{
+			record.Time.Format("2006-01-02"),
+			record.Time.Format("15:04"),
+			record.Name,
+			status,
+			record.Room,
+			record.From,
+			string(record.Source),
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return exit.MakeIOErr(errors.Wrap(err, "Failed to write CSV"))
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package labbot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/labbot/internal/testserver"
+)
+
+func TestResetPresenceOfRunningServer(t *testing.T) {
+	slack := testserver.NewSlack()
+	defer slack.Close()
+	line := testserver.NewLINE()
+	defer line.Close()
+	l, _ := newTestLabbot(t, slack, line)
+	l.leader = 1
+	pubsub, err := l.subscribePresenceReset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pubsub.Close()
+
+	now := time.Now()
+	setCameTimeStamp("ありす", "実験室", now)
+	setCameTimeStamp("ぼぶ", "実験室", now)
+	l.storePeopleData()
+
+	// The CLI is another process which shares only redis
+	if err := l.resetPresence([]string{"ありす"}); err != nil {
+		t.Fatalf("resetPresence() = %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for isAlready("ありす") {
+		if time.Now().After(deadline) {
+			t.Fatal("the server still has the presence after reset")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !isAlready("ぼぶ") {
+		t.Error("the presence of others is reset")
+	}
+
+	// The server doesn't write the reset presence back
+	setLeaveTimeStamp("ぼぶ", now)
+	l.storePeopleData()
+	people, err := l.loadPresence()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := people["ありす"]; ok {
+		t.Error("the reset presence is written back")
+	}
+}
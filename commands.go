@@ -0,0 +1,142 @@
+package labbot
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron"
+	"go.uber.org/zap"
+)
+
+// commandRequest is a message sent to the bot from slack or LINE
+type commandRequest struct {
+	Text string
+	// UserID is the id of sender on slack or LINE
+	UserID string
+	// member returns the name of lab member who sent the message
+	member func() (string, error)
+}
+
+// command is answered in the same way on slack and LINE
+type command struct {
+	// usage is the id of message which shows the keyword in help
+	usage    string
+	keywords []string
+	// action is used as postback data of LINE rich menu, e.g. "action=whoisthere"
+	action string
+	run    func(l *labbot, req *commandRequest) string
+}
+
+var commands = []*command{
+	{
+		usage:    "usage.whoisthere",
+		keywords: []string{"誰がい", "だれがい", "誰かいる", "今いる人", "who is here", "who's here"},
+		action:   "whoisthere",
+		run:      (*labbot).peopleInLab,
+	},
+	{
+		usage:    "usage.week",
+		keywords: []string{"今週の時間", "今週の記録", "this week"},
+		action:   "week",
+		run:      (*labbot).workingTimeOfWeek,
+	},
+	{
+		usage:    "usage.seminar",
+		keywords: []string{"ゼミいつ", "ｾﾞﾐいつ", "次のゼミ", "次のｾﾞﾐ", "next seminar"},
+		action:   "seminar",
+		run:      (*labbot).nextSeminar,
+	},
+}
+
+// answer finds the command which matches the text, and returns the reply.
+func (l *labbot) answer(cmds []*command, req *commandRequest) (string, bool) {
+	for _, cmd := range cmds {
+		for _, keyword := range cmd.keywords {
+			if strings.Contains(req.Text, keyword) {
+				return cmd.run(l, req), true
+			}
+		}
+	}
+	return "", false
+}
+
+// findAction returns the command which has the action.
+func findAction(cmds []*command, action string) (*command, bool) {
+	for _, cmd := range cmds {
+		if cmd.action != "" && cmd.action == action {
+			return cmd, true
+		}
+	}
+	return nil, false
+}
+
+// 誰がいる?
+func (l *labbot) peopleInLab(req *commandRequest) string {
+	rooms := make(map[string][]string)
+	mu.RLock()
+	for _, who := range timeStamp {
+		if who.Inlab {
+			room := who.Room
+			if room == "" {
+				room = l.DefaultRoom
+			}
+			rooms[room] = append(rooms[room], who.Name)
+		}
+	}
+	mu.RUnlock()
+	locale := l.localeOfRequest(req) // locale.go
+	if len(rooms) == 0 {
+		return l.messageIn(locale, "people.nobody", &messageData{})
+	}
+	names := make([]string, 0, len(rooms))
+	for room := range rooms {
+		names = append(names, room)
+	}
+	sort.Strings(names)
+	lines := make([]string, 0, len(rooms))
+	for _, room := range names {
+		list := rooms[room]
+		sort.Strings(list)
+		lines = append(lines, l.messageIn(locale, "people.room", &messageData{
+			Room:  room,
+			Names: strings.Join(list, listSeparator(locale)),
+		}))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// 今週の時間
+func (l *labbot) workingTimeOfWeek(req *commandRequest) string {
+	name, err := req.member()
+	if err != nil {
+		l.Error("Could not find member name", zap.Error(err))
+		return l.message("member.unknown", &messageData{})
+	}
+	locale := l.localeOf(name) // locale.go
+	now := time.Now()
+	since := beginningOfWeek(now)
+	records, err := l.history(since)
+	if err != nil {
+		l.Error("Could not get history", zap.Error(err))
+		return l.messageIn(locale, "history.failed", &messageData{})
+	}
+	sum := workingTime(records, name, since, now)
+	return l.messageIn(locale, "week", &messageData{
+		Name:    name,
+		Hours:   int(sum.Hours()),
+		Minutes: int(sum.Minutes()) % 60,
+	})
+}
+
+// ゼミいつ?
+func (l *labbot) nextSeminar(req *commandRequest) string {
+	locale := l.localeOfRequest(req)
+	schedule, err := cron.Parse(seminarSpec)
+	if err != nil {
+		l.Error("Invalid seminar schedule", zap.Error(err))
+		return l.messageIn(locale, "seminar.failed", &messageData{})
+	}
+	next := schedule.Next(time.Now())
+	return l.messageIn(locale, "seminar.next", &messageData{Time: formatTime(locale, next)})
+}
@@ -9,26 +9,76 @@ func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
-func (l *labbot) isThereProgress() {
-	l.sendToSlack("general", "<!here> みなさん、進捗どうですか!?")
+// seminarSpec is the schedule of noticeSeminar
+const seminarSpec = "0 0 10 * * 5"
+
+// cronJob is a scheduled job, the name is used by --line-announce and "labbot cron"
+type cronJob struct {
+	name string
+	spec string
+	run  func(l *labbot) error
+	// catchUp is the policy for the run which is missed during downtime,
+	// it can be overridden by --catch-up. See catchup.go
+	catchUp string
+	// quiet jobs run too often to keep successful runs in the history,
+	// only failures and the last success are recorded. See jobs.go
+	quiet bool
+}
+
+var cronJobs = []cronJob{
+	{name: "progress", spec: "0 30 18 * * *", run: (*labbot).isThereProgress, catchUp: catchUpSkip},
+	{name: "seminar", spec: seminarSpec, run: (*labbot).noticeSeminar, catchUp: catchUpRun},
+	{name: "clean", spec: "0 0 15 * * 1,3,5", run: (*labbot).noticeClean, catchUp: catchUpSkip},
+	{name: "day-after-tomorrow", spec: "0 0 17 * * 3", run: (*labbot).noticeDayAfterTomorrow, catchUp: catchUpRun},
+	{name: "refresh-members", spec: "0 0 4 * * *", run: (*labbot).refreshMembers, catchUp: catchUpRun}, // members.go
+	// Reminders due during downtime are escalated by the next run, so it isn't caught up
+	{name: "last-out", spec: "0 * * * * *", run: (*labbot).sweepLastOut, catchUp: catchUpSkip, quiet: true}, // lastout.go
+}
+
+// isCronJob reports whether the job of the name is in cronJobs.
+func isCronJob(name string) bool {
+	for _, job := range cronJobs {
+		if job.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// announce sends the message to chat in --locale, and to LINE in the locale of each member
+// if the job is configured by --line-announce.
+// LINE is tried even if chat fails, and the first error is returned.
+// Messages are in persona.go
+func (l *labbot) announce(job, channel string, data *messageData) error {
+	err := l.postToChat(channel, l.message(job, data))
+	for _, name := range l.LineAnnounce {
+		if name != job {
+			continue
+		}
+		lineErr := l.multicastLocalized(func(locale string) string { // line.go
+			return stripSlackMarkup(l.messageIn(locale, job, data))
+		})
+		if err == nil {
+			err = lineErr
+		}
+		break
+	}
+	return err
 }
 
-func (l *labbot) noticeSeminar() {
-	l.sendToSlack("tamaki", "<!channel> みなさん、今日はｾﾞﾐの日ですよ!\n私も応援してますからね!")
+func (l *labbot) isThereProgress() error {
+	return l.announce("progress", "general", &messageData{})
 }
 
-func (l *labbot) noticeDayAfterTomorrow() {
-	l.sendToSlack("tamaki", "<!channel> 明後日はｾﾞﾐの日ですよ!")
+func (l *labbot) noticeSeminar() error {
+	return l.announce("seminar", "tamaki", &messageData{Presenter: l.presenter(time.Now())})
 }
 
-var messages = []string{
-	"机の上にあるｺﾞﾐはｺﾞﾐ箱に入れましょう!",
-	"たまには掃除機を使って床を掃除してあげてくださいっ!",
-	"ｾﾞﾐの後は綺麗な空間でゆっくり休んで欲しいです。",
-	"たまには机の上も拭きましょうねっ!",
+func (l *labbot) noticeDayAfterTomorrow() error {
+	// The seminar is on the day after tomorrow
+	return l.announce("day-after-tomorrow", "tamaki", &messageData{Presenter: l.presenter(time.Now().AddDate(0, 0, 2))})
 }
 
-func (l *labbot) noticeClean() {
-	msg := messages[rand.Intn(len(messages))]
-	l.sendToSlack("general", "<!channel> みなさんっ！掃除はしてますか？\n"+msg)
+func (l *labbot) noticeClean() error {
+	return l.announce("clean", "general", &messageData{})
 }
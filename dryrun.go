@@ -0,0 +1,82 @@
+package labbot
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// dryRunChat is ChatAdapter for --dry-run, it logs messages instead of posting them.
+// Lookups of users and channels are passed to the real platform.
+type dryRunChat struct {
+	ChatAdapter
+	*zap.Logger
+}
+
+func (d *dryRunChat) PostMessage(channelID string, msg *ChatMessage) error {
+	fields := []zap.Field{
+		zap.String("chat", d.Name()),
+		zap.String("channelID", channelID),
+		zap.String("text", msg.Text),
+	}
+	if a := msg.Attachment; a != nil {
+		choices := make([]string, 0, len(a.Choices))
+		for _, choice := range a.Choices {
+			choices = append(choices, choice.Text)
+		}
+		fields = append(fields,
+			zap.String("attachment", a.Text),
+			zap.String("footer", a.Footer),
+			zap.Strings("choices", choices),
+		)
+	}
+	d.Info("dry-run: message is not posted", fields...)
+	return nil
+}
+
+// dryRunTransport is the transport of LINE client for --dry-run. GET requests
+// like profiles are sent, and the others like reply and multicast are logged
+// and succeed without sending.
+type dryRunTransport struct {
+	base http.RoundTripper
+	*zap.Logger
+}
+
+func (t *dryRunTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet {
+		return t.base.RoundTrip(req)
+	}
+
+	fields := []zap.Field{
+		zap.String("method", req.Method),
+		zap.String("path", req.URL.Path),
+	}
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+			fields = append(fields, zap.String("body", string(body)))
+		} else {
+			// e.g. the image of rich menu
+			fields = append(fields, zap.Int("size", len(body)))
+		}
+	}
+	t.Info("dry-run: LINE request is not sent", fields...)
+
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString("{}")),
+		Request:    req,
+	}, nil
+}
@@ -0,0 +1,134 @@
+package labbot
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/labbot/internal/linewebhook"
+	"github.com/Code-Hex/labbot/internal/testserver"
+	"github.com/go-redis/redis"
+	"go.uber.org/zap"
+)
+
+// newTestLabbot runs labbot with fake Slack and LINE. It needs redis whose database is
+// flushed by the test, which is given by LABBOT_TEST_REDIS (e.g. 127.0.0.1:6379).
+func newTestLabbot(t *testing.T, slack *testserver.Slack, line *testserver.LINE) (*labbot, *httptest.Server) {
+	addr := os.Getenv("LABBOT_TEST_REDIS")
+	if addr == "" {
+		t.Skip("LABBOT_TEST_REDIS is not set")
+	}
+	secret := channelSecret
+	channelSecret = "test-channel-secret"
+	t.Cleanup(func() { channelSecret = secret })
+
+	l := New()
+	if _, err := l.Options.parse([]string{"--slack-api", slack.APIURL(), "--line-api", line.URL}); err != nil {
+		t.Fatal(err)
+	}
+	l.Logger = zap.NewNop()
+	l.Redis = redis.NewClient(&redis.Options{Addr: addr})
+	if err := l.Redis.FlushDB().Err(); err != nil {
+		t.Fatalf("Failed to flush redis: %v", err)
+	}
+	persona, err := loadPersona("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.persona = persona
+	if l.LINE, err = l.newLINEClient(); err != nil {
+		t.Fatal(err)
+	}
+	l.Chat = l.newChatAdapter()
+	handler, err := l.registerHandlers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(handler)
+	t.Cleanup(func() {
+		srv.Close()
+		l.Redis.Close()
+	})
+	return l, srv
+}
+
+func TestBeaconEnterEndToEnd(t *testing.T) {
+	slack := testserver.NewSlack()
+	defer slack.Close()
+	line := testserver.NewLINE()
+	defer line.Close()
+	line.AddProfile("U1", "ありす")
+	l, srv := newTestLabbot(t, slack, line)
+
+	// Records older than a day are expired, so she came 6 hours ago.
+	// Messages must use the time of the event, not the time when it's handled.
+	at := time.Now().Add(-6 * time.Hour).Truncate(time.Second)
+	req, err := linewebhook.NewWebhookRequest(srv.URL+"/line", channelSecret, linewebhook.BeaconEvent("U1", "0123456789", "enter", at))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status of webhook = %d", res.StatusCode)
+	}
+
+	// The arrival is posted to #timestamp at the time of the event
+	for {
+		msg, err := slack.WaitMessage(5 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Channel != "CTIMESTAMP" {
+			continue
+		}
+		if len(msg.Attachments) == 0 {
+			t.Fatalf("message has no attachment: %+v", msg)
+		}
+		text := msg.Attachments[0].Text
+		if !strings.Contains(text, "ありす") || !strings.Contains(text, formatTime(l.Locale, at)) {
+			t.Errorf("arrival = %q", text)
+		}
+		break
+	}
+
+	// and the member is greeted on LINE
+	sent, err := line.WaitSent("/v2/bot/message/reply", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sent.Messages) == 0 || sent.Messages[0].Text != l.greeting(l.Locale, "ありす", at) {
+		t.Errorf("greeting = %+v", sent.Messages)
+	}
+	if !isAlready("ありす") {
+		t.Error("ありす is not in the lab")
+	}
+
+	// She leaves now, so she worked for 6 hours
+	req, err = linewebhook.NewWebhookRequest(srv.URL+"/line", channelSecret, linewebhook.BeaconEvent("U1", "0123456789", "leave", at.Add(6*time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	sent, err = line.WaitSent("/v2/bot/message/reply", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := l.message("leave.long", &messageData{Name: "ありす", Hours: 6})
+	if len(sent.Messages) == 0 || sent.Messages[0].Text != want {
+		t.Errorf("farewell = %+v, want %q", sent.Messages, want)
+	}
+	if isAlready("ありす") {
+		t.Error("ありす is still in the lab")
+	}
+}
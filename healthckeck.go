@@ -2,10 +2,20 @@ package labbot
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/robfig/cron"
 )
 
+// healthCheck is the liveness, it only tells the process is running.
 func healthCheck(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(struct {
@@ -14,3 +24,199 @@ func healthCheck(w http.ResponseWriter, r *http.Request) {
 		Goroutine: runtime.NumGoroutine(),
 	})
 }
+
+const (
+	statusOK       = "ok"
+	statusDegraded = "degraded"
+	statusDown     = "down"
+)
+
+// readyTimeout is the time limit of each component check
+const readyTimeout = 5 * time.Second
+
+// externalCheckTTL is how long results of chat and LINE checks are reused,
+// so that probes don't hit rate limits of their APIs.
+const externalCheckTTL = time.Minute
+
+// componentStatus is the result of checking a dependency
+type componentStatus struct {
+	Status string `json:"status"`
+	// Critical component makes /readyz 503 when it is down
+	Critical bool    `json:"critical"`
+	Latency  float64 `json:"latency_ms,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	// Jobs is the next run times of cron jobs
+	Jobs map[string]string `json:"jobs,omitempty"`
+}
+
+type readiness struct {
+	Status     string                      `json:"status"`
+	Components map[string]*componentStatus `json:"components"`
+}
+
+type componentCheck struct {
+	name     string
+	critical bool
+	check    func() (*componentStatus, error)
+}
+
+// checkCache keeps the result of a check for a while.
+type checkCache struct {
+	mu      sync.Mutex
+	checked time.Time
+	status  *componentStatus
+	err     error
+}
+
+// do returns the last result if it's newer than ttl, or runs check.
+func (c *checkCache) do(ttl time.Duration, check func() (*componentStatus, error)) (*componentStatus, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.checked.IsZero() || time.Since(c.checked) >= ttl {
+		c.status, c.err = check()
+		c.checked = time.Now()
+	}
+	if c.status == nil {
+		return nil, c.err
+	}
+	// runCheck modifies the status
+	status := *c.status
+	return &status, c.err
+}
+
+// readyCheck is "/readyz" handler, it checks dependencies and responds 503
+// when redis is down. Outages of chat and LINE only degrade it, because
+// LINE webhooks should be received even while they are down.
+func (l *labbot) readyCheck(w http.ResponseWriter, r *http.Request) {
+	checks := []componentCheck{
+		{name: "redis", critical: true, check: l.checkRedis},
+		{name: "chat", check: l.checkChat},
+		{name: "chat_listener", check: l.checkChatListener},
+		{name: "line", check: l.checkLINE},
+		{name: "cron", check: l.checkCron},
+	}
+
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		res = readiness{Status: statusOK, Components: make(map[string]*componentStatus)}
+	)
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c componentCheck) {
+			defer wg.Done()
+			status := runCheck(c)
+			mu.Lock()
+			res.Components[c.name] = status
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+
+	for _, status := range res.Components {
+		if status.Status == statusOK {
+			continue
+		}
+		if status.Critical {
+			res.Status = statusDown
+		} else if res.Status == statusOK {
+			res.Status = statusDegraded
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if res.Status == statusDown {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// runCheck runs the check with readyTimeout and measures the latency.
+func runCheck(c componentCheck) *componentStatus {
+	type result struct {
+		status *componentStatus
+		err    error
+	}
+	done := make(chan result, 1)
+	start := time.Now()
+	go func() {
+		status, err := c.check()
+		done <- result{status, err}
+	}()
+
+	var status *componentStatus
+	select {
+	case r := <-done:
+		status = r.status
+		if status == nil {
+			status = &componentStatus{Status: statusOK}
+		}
+		if r.err != nil {
+			status.Status = statusDown
+			status.Error = r.err.Error()
+		}
+	case <-time.After(readyTimeout):
+		status = &componentStatus{
+			Status: statusDown,
+			Error:  fmt.Sprintf("timed out after %s", readyTimeout),
+		}
+	}
+	status.Critical = c.critical
+	status.Latency = float64(time.Since(start)) / float64(time.Millisecond)
+	return status
+}
+
+func (l *labbot) checkRedis() (*componentStatus, error) {
+	return nil, l.Redis.Ping().Err()
+}
+
+func (l *labbot) checkChat() (*componentStatus, error) {
+	return l.chatReady.do(externalCheckTTL, func() (*componentStatus, error) {
+		return nil, l.Chat.Ping()
+	})
+}
+
+func (l *labbot) checkChatListener() (*componentStatus, error) {
+	if !l.Chat.Connected() {
+		return nil, errors.Errorf("%s is not connected", l.Chat.Name())
+	}
+	return nil, nil
+}
+
+// checkLINE verifies the channel access token.
+func (l *labbot) checkLINE() (*componentStatus, error) {
+	return l.lineReady.do(externalCheckTTL, l.verifyLINEToken)
+}
+
+func (l *labbot) verifyLINEToken() (*componentStatus, error) {
+	base := "https://api.line.me"
+	if l.LineAPI != "" {
+		base = strings.TrimRight(l.LineAPI, "/")
+	}
+	client := &http.Client{Timeout: readyTimeout}
+	res, err := client.PostForm(base+"/v2/oauth/verify", url.Values{"access_token": {channelToken}})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to verify LINE token")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("LINE token is invalid: %s", res.Status)
+	}
+	return nil, nil
+}
+
+func (l *labbot) checkCron() (*componentStatus, error) {
+	status := &componentStatus{Status: statusOK, Jobs: make(map[string]string)}
+	now := time.Now()
+	for _, job := range cronJobs {
+		schedule, err := cron.Parse(job.spec)
+		if err != nil {
+			return status, errors.Wrapf(err, "Invalid spec of %s", job.name)
+		}
+		status.Jobs[job.name] = schedule.Next(now).Format(time.RFC3339)
+	}
+	if atomic.LoadInt32(&l.cronRunning) == 0 {
+		return status, errors.New("cron scheduler is not running")
+	}
+	return status, nil
+}
@@ -0,0 +1,59 @@
+package labbot
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/labbot/internal/testserver"
+)
+
+func TestCheckCache(t *testing.T) {
+	var c checkCache
+	calls := 0
+	check := func() (*componentStatus, error) {
+		calls++
+		return nil, errors.New("auth.test is rate limited")
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.do(time.Minute, check); err == nil {
+			t.Errorf("#%d: the cached error is lost", i)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("check is called %d times within ttl, want 1", calls)
+	}
+
+	// The result is checked again after ttl
+	c.checked = c.checked.Add(-time.Minute)
+	c.do(time.Minute, check)
+	if calls != 2 {
+		t.Errorf("check is called %d times after ttl, want 2", calls)
+	}
+}
+
+func TestReadyCheckDuringChatOutage(t *testing.T) {
+	slack := testserver.NewSlack()
+	line := testserver.NewLINE()
+	defer line.Close()
+	l, _ := newTestLabbot(t, slack, line)
+	slack.Close()
+
+	w := httptest.NewRecorder()
+	l.readyCheck(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	// LINE webhooks must be received during the outage of slack
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var res readiness
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != statusDegraded || res.Components["chat"].Status != statusDown {
+		t.Errorf("readiness = %s, chat = %+v", res.Status, res.Components["chat"])
+	}
+}
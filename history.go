@@ -0,0 +1,123 @@
+package labbot
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// source describes where a presence change came from
+type source string
+
+const (
+	sourceBeacon  source = "beacon"
+	sourceManual  source = "manual"
+	sourceKiosk   source = "kiosk"
+	sourceNetwork source = "network"
+	sourceLINE    source = "line"
+)
+
+// sourceLabel returns the name of source which is shown on chat in --locale
+func (l *labbot) sourceLabel(s source) string {
+	switch s {
+	case sourceBeacon, sourceManual, sourceKiosk, sourceNetwork, sourceLINE:
+		return l.message("source."+string(s), &messageData{})
+	}
+	return string(s)
+}
+
+// Record is an entry of the attendance history
+//
+// When a person moves between rooms, Inlab is true and From is the previous room.
+type Record struct {
+	Name   string    `json:"name"`
+	Inlab  bool      `json:"in_lab"`
+	Room   string    `json:"room,omitempty"`
+	From   string    `json:"from,omitempty"`
+	Source source    `json:"source"`
+	Time   time.Time `json:"time"`
+}
+
+const historyKey = key + ":history"
+
+func (l *labbot) appendHistory(rec Record) {
+	serialized, err := json.Marshal(rec)
+	if err != nil {
+		l.Error("JSON Marshal error", zap.Error(err))
+		return
+	}
+	if err := l.Redis.RPush(historyKey, string(serialized)).Err(); err != nil {
+		l.Error("Could not push history to redis", zap.Error(err))
+	}
+}
+
+// history returns attendance records which are recorded since the given time.
+func (l *labbot) history(since time.Time) ([]*Record, error) {
+	list, err := l.Redis.LRange(historyKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*Record, 0, len(list))
+	for _, serialized := range list {
+		rec := new(Record)
+		if err := json.Unmarshal([]byte(serialized), rec); err != nil {
+			l.Warn("Could not unmarshal history", zap.Error(err))
+			continue
+		}
+		if rec.Time.Before(since) {
+			continue
+		}
+		records = append(records, rec)
+	}
+	// backdated records may be pushed after newer records
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	return records, nil
+}
+
+// workingTime sums up the time which the person stayed in the lab between since and now.
+func workingTime(records []*Record, name string, since, now time.Time) time.Duration {
+	var (
+		sum     time.Duration
+		came    time.Time
+		staying bool
+		first   = true
+	)
+	for _, rec := range records {
+		if rec.Name != name || rec.Time.Before(since) || rec.Time.After(now) {
+			continue
+		}
+		// moving between rooms
+		if rec.From != "" {
+			continue
+		}
+		if rec.Inlab {
+			if !staying {
+				came, staying = rec.Time, true
+			}
+		} else {
+			if staying {
+				sum += rec.Time.Sub(came)
+			} else if first {
+				// came before since
+				sum += rec.Time.Sub(since)
+			}
+			staying = false
+		}
+		first = false
+	}
+	if staying {
+		sum += now.Sub(came)
+	}
+	return sum
+}
+
+// beginningOfWeek returns monday 00:00 of the week.
+func beginningOfWeek(t time.Time) time.Time {
+	days := (int(t.Weekday()) + 6) % 7 // monday is 0
+	y, m, d := t.AddDate(0, 0, -days).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
@@ -0,0 +1,68 @@
+// Package linewebhook builds signed webhook requests of LINE Messaging API,
+// which are posted by "labbot simulate" and end-to-end tests.
+//
+//	req, err := linewebhook.NewWebhookRequest(
+//		"http://localhost:8080/line",
+//		channelSecret,
+//		linewebhook.BeaconEvent("U1234", "0123456789", "enter", time.Now()),
+//	)
+package linewebhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Sign returns X-Line-Signature of the webhook body.
+func Sign(channelSecret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(channelSecret))
+	mac.Write(body)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// BeaconEvent returns the webhook event of LINE Beacon. typ is "enter" or "leave".
+func BeaconEvent(userID, hwid, typ string, at time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"type":       "beacon",
+		"replyToken": fmt.Sprintf("reply-%s-%d", userID, at.UnixNano()),
+		"timestamp":  at.UnixNano() / int64(time.Millisecond),
+		"source":     map[string]string{"type": "user", "userId": userID},
+		"beacon":     map[string]string{"hwid": hwid, "type": typ},
+	}
+}
+
+// TextEvent returns the webhook event of text message.
+func TextEvent(userID, text string, at time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"type":       "message",
+		"replyToken": fmt.Sprintf("reply-%s-%d", userID, at.UnixNano()),
+		"timestamp":  at.UnixNano() / int64(time.Millisecond),
+		"source":     map[string]string{"type": "user", "userId": userID},
+		"message": map[string]string{
+			"id":   fmt.Sprintf("%d", at.UnixNano()),
+			"type": "text",
+			"text": text,
+		},
+	}
+}
+
+// NewWebhookRequest returns the signed request of LINE webhook to url, e.g. "http://localhost:8080/line".
+func NewWebhookRequest(url, channelSecret string, events ...map[string]interface{}) (*http.Request, error) {
+	body, err := json.Marshal(map[string]interface{}{"events": events})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Line-Signature", Sign(channelSecret, body))
+	return req, nil
+}
@@ -0,0 +1,49 @@
+package linewebhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestNewWebhookRequest(t *testing.T) {
+	at := time.Date(2017, 10, 18, 9, 30, 0, 0, time.UTC)
+	req, err := NewWebhookRequest("http://localhost:8080/line", "secret", BeaconEvent("U1", "0123456789", "enter", at))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := req.Header.Get("X-Line-Signature"), Sign("secret", body); got != want {
+		t.Errorf("signature = %q, want %q", got, want)
+	}
+	if req.Header.Get("X-Line-Signature") == Sign("other", body) {
+		t.Error("signature doesn't depend on the channel secret")
+	}
+
+	var webhook struct {
+		Events []struct {
+			Type      string
+			Timestamp int64
+			Source    struct{ UserID string }
+			Beacon    struct{ Hwid, Type string }
+		}
+	}
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		t.Fatal(err)
+	}
+	if len(webhook.Events) != 1 {
+		t.Fatalf("events = %d, want 1", len(webhook.Events))
+	}
+	event := webhook.Events[0]
+	if event.Type != "beacon" || event.Source.UserID != "U1" || event.Beacon.Hwid != "0123456789" || event.Beacon.Type != "enter" {
+		t.Errorf("event = %+v", event)
+	}
+	// LINE sends the time in milliseconds
+	if event.Timestamp != at.Unix()*1000 {
+		t.Errorf("timestamp = %d, want %d", event.Timestamp, at.Unix()*1000)
+	}
+}
@@ -0,0 +1,137 @@
+package testserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LINEProfile is a profile which fake LINE returns
+type LINEProfile struct {
+	UserID        string `json:"userId"`
+	DisplayName   string `json:"displayName"`
+	PictureURL    string `json:"pictureUrl"`
+	StatusMessage string `json:"statusMessage"`
+}
+
+// LINEMessage is a message sent by reply, push or multicast api
+type LINEMessage struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// LINESent is a request of reply, push or multicast api
+type LINESent struct {
+	ReplyToken string        `json:"replyToken"`
+	To         interface{}   `json:"to"` // string for push, []string for multicast
+	Messages   []LINEMessage `json:"messages"`
+}
+
+// LINE is a fake LINE Messaging API. Pass its URL to --line-api.
+type LINE struct {
+	*httptest.Server
+	*recorder
+
+	mu        sync.Mutex
+	profiles  map[string]*LINEProfile
+	richMenus map[string]json.RawMessage
+	seq       int
+}
+
+// NewLINE starts fake LINE Messaging API.
+func NewLINE() *LINE {
+	l := &LINE{
+		recorder:  newRecorder(),
+		profiles:  make(map[string]*LINEProfile),
+		richMenus: make(map[string]json.RawMessage),
+	}
+	l.Server = httptest.NewServer(http.HandlerFunc(l.api))
+	return l
+}
+
+// AddProfile adds the profile of LINE user.
+func (l *LINE) AddProfile(userID, displayName string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.profiles[userID] = &LINEProfile{UserID: userID, DisplayName: displayName}
+}
+
+func (l *LINE) api(w http.ResponseWriter, r *http.Request) {
+	call := l.record(r)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	path := call.Path
+	switch {
+	case path == "/v2/bot/message/reply",
+		path == "/v2/bot/message/push",
+		path == "/v2/bot/message/multicast":
+		writeJSON(w, struct{}{})
+	case path == "/v2/oauth/verify":
+		writeJSON(w, map[string]interface{}{"scope": "P", "client_id": "1234567890", "expires_in": 2592000})
+	case strings.HasPrefix(path, "/v2/bot/profile/"):
+		profile, ok := l.profiles[strings.TrimPrefix(path, "/v2/bot/profile/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			writeJSON(w, map[string]string{"message": "Not found"})
+			return
+		}
+		writeJSON(w, profile)
+	case path == "/v2/bot/richmenu/list":
+		menus := make([]json.RawMessage, 0, len(l.richMenus))
+		for _, menu := range l.richMenus {
+			menus = append(menus, menu)
+		}
+		writeJSON(w, map[string]interface{}{"richmenus": menus})
+	case path == "/v2/bot/richmenu" && r.Method == http.MethodPost:
+		l.seq++
+		id := fmt.Sprintf("richmenu-%d", l.seq)
+		var menu map[string]interface{}
+		json.Unmarshal(call.Body, &menu)
+		if menu == nil {
+			menu = make(map[string]interface{})
+		}
+		menu["richMenuId"] = id
+		serialized, _ := json.Marshal(menu)
+		l.richMenus[id] = serialized
+		writeJSON(w, map[string]string{"richMenuId": id})
+	case strings.HasPrefix(path, "/v2/bot/richmenu/") && r.Method == http.MethodDelete:
+		delete(l.richMenus, strings.TrimPrefix(path, "/v2/bot/richmenu/"))
+		writeJSON(w, struct{}{})
+	case strings.HasPrefix(path, "/v2/bot/richmenu/"),
+		strings.HasPrefix(path, "/v2/bot/user/"):
+		// upload image, set default rich menu
+		writeJSON(w, struct{}{})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		writeJSON(w, map[string]string{"message": "Not found"})
+	}
+}
+
+// Sent returns requests of the api, e.g. "/v2/bot/message/reply".
+func (l *LINE) Sent(path string) []*LINESent {
+	var sent []*LINESent
+	for _, call := range l.CallsTo(path) {
+		s := new(LINESent)
+		call.JSON(s)
+		sent = append(sent, s)
+	}
+	return sent
+}
+
+// WaitSent waits for the request of the api, e.g. "/v2/bot/message/multicast".
+func (l *LINE) WaitSent(path string, timeout time.Duration) (*LINESent, error) {
+	call, err := l.WaitCall(path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	s := new(LINESent)
+	if err := call.JSON(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,202 @@
+package testserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MattermostUser is a user of fake mattermost
+type MattermostUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Nickname string `json:"nickname"`
+}
+
+// MattermostChannel is a channel of fake mattermost, Type is "O" or "D" for direct messages
+type MattermostChannel struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	TeamID string `json:"team_id"`
+	Type   string `json:"type"`
+}
+
+// MattermostAction is a button of posted message
+type MattermostAction struct {
+	Name        string `json:"name"`
+	Style       string `json:"style"`
+	Integration struct {
+		URL     string            `json:"url"`
+		Context map[string]string `json:"context"`
+	} `json:"integration"`
+}
+
+// MattermostAttachment is an attachment of posted message
+type MattermostAttachment struct {
+	Text    string             `json:"text"`
+	Color   string             `json:"color"`
+	Footer  string             `json:"footer"`
+	Actions []MattermostAction `json:"actions"`
+}
+
+// MattermostPost is a message posted by POST /api/v4/posts
+type MattermostPost struct {
+	ChannelID string `json:"channel_id"`
+	Message   string `json:"message"`
+	Props     struct {
+		Attachments []MattermostAttachment `json:"attachments"`
+	} `json:"props"`
+}
+
+// MattermostTeam is the name of the team which fake mattermost has
+const MattermostTeam = "tamaki"
+
+// Mattermost is a fake mattermost which serves API v4 under /api/v4/. Pass its URL to MATTERMOST_URL.
+// Requests without "Bearer <Token>" are rejected.
+type Mattermost struct {
+	*httptest.Server
+	*recorder
+	Token string
+
+	mu       sync.Mutex
+	users    []MattermostUser
+	channels []MattermostChannel
+}
+
+// NewMattermost starts fake mattermost which has the bot user and channels
+// "general", "tamaki" and "timestamp".
+func NewMattermost() *Mattermost {
+	m := &Mattermost{
+		recorder: newRecorder(),
+		Token:    "mattermost-token",
+		users: []MattermostUser{
+			{ID: BotID, Username: "chihiro"},
+		},
+		channels: []MattermostChannel{
+			{ID: "CGENERAL", Name: "general", TeamID: MattermostTeam, Type: "O"},
+			{ID: "CTAMAKI", Name: "tamaki", TeamID: MattermostTeam, Type: "O"},
+			{ID: "CTIMESTAMP", Name: "timestamp", TeamID: MattermostTeam, Type: "O"},
+		},
+	}
+	m.Server = httptest.NewServer(http.HandlerFunc(m.api))
+	return m
+}
+
+// AddUser adds the user to fake mattermost.
+func (m *Mattermost) AddUser(id, username, nickname string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users = append(m.users, MattermostUser{ID: id, Username: username, Nickname: nickname})
+}
+
+func (m *Mattermost) api(w http.ResponseWriter, r *http.Request) {
+	call := m.record(r)
+	if r.Header.Get("Authorization") != "Bearer "+m.Token {
+		w.WriteHeader(http.StatusUnauthorized)
+		writeJSON(w, map[string]string{"message": "invalid token"})
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path := strings.TrimPrefix(call.Path, "/api/v4")
+	switch {
+	case r.Method == http.MethodPost && path == "/posts":
+		var post MattermostPost
+		if err := call.JSON(&post); err != nil || post.ChannelID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"message": "invalid post"})
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, map[string]string{"id": "P" + call.Time.Format("150405.000000")})
+	case r.Method == http.MethodPost && path == "/channels/direct":
+		var ids []string
+		if err := call.JSON(&ids); err != nil || len(ids) != 2 {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"message": "invalid user ids"})
+			return
+		}
+		sort.Strings(ids)
+		channel := MattermostChannel{ID: "D" + ids[0] + ids[1], Name: ids[0] + "__" + ids[1], Type: "D"}
+		if !m.hasChannel(channel.ID) {
+			m.channels = append(m.channels, channel)
+		}
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, channel)
+	case path == "/users/me":
+		writeJSON(w, m.users[0])
+	case strings.HasPrefix(path, "/users/username/"):
+		m.writeUser(w, func(u MattermostUser) bool { return u.Username == strings.TrimPrefix(path, "/users/username/") })
+	case strings.HasPrefix(path, "/users/"):
+		m.writeUser(w, func(u MattermostUser) bool { return u.ID == strings.TrimPrefix(path, "/users/") })
+	case strings.HasPrefix(path, "/teams/name/"+MattermostTeam+"/channels/name/"):
+		name := strings.TrimPrefix(path, "/teams/name/"+MattermostTeam+"/channels/name/")
+		m.writeChannel(w, func(c MattermostChannel) bool { return c.TeamID == MattermostTeam && c.Name == name })
+	case strings.HasPrefix(path, "/channels/"):
+		id := strings.TrimPrefix(path, "/channels/")
+		m.writeChannel(w, func(c MattermostChannel) bool { return c.ID == id })
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		writeJSON(w, map[string]string{"message": "unknown api"})
+	}
+}
+
+func (m *Mattermost) hasChannel(id string) bool {
+	for _, channel := range m.channels {
+		if channel.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Mattermost) writeUser(w http.ResponseWriter, match func(MattermostUser) bool) {
+	for _, user := range m.users {
+		if match(user) {
+			writeJSON(w, user)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+	writeJSON(w, map[string]string{"message": "user not found"})
+}
+
+func (m *Mattermost) writeChannel(w http.ResponseWriter, match func(MattermostChannel) bool) {
+	for _, channel := range m.channels {
+		if match(channel) {
+			writeJSON(w, channel)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+	writeJSON(w, map[string]string{"message": "channel not found"})
+}
+
+// Posts returns messages posted by POST /api/v4/posts.
+func (m *Mattermost) Posts() []*MattermostPost {
+	var posts []*MattermostPost
+	for _, call := range m.CallsTo("/api/v4/posts") {
+		post := new(MattermostPost)
+		if call.JSON(post) == nil {
+			posts = append(posts, post)
+		}
+	}
+	return posts
+}
+
+// WaitPost waits for the message posted by POST /api/v4/posts.
+func (m *Mattermost) WaitPost(timeout time.Duration) (*MattermostPost, error) {
+	call, err := m.WaitCall("/api/v4/posts", timeout)
+	if err != nil {
+		return nil, err
+	}
+	post := new(MattermostPost)
+	if err := call.JSON(post); err != nil {
+		return nil, err
+	}
+	return post, nil
+}
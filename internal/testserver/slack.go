@@ -0,0 +1,276 @@
+package testserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SlackUser is a user of fake slack
+type SlackUser struct {
+	ID      string           `json:"id"`
+	Name    string           `json:"name"`
+	Profile SlackUserProfile `json:"profile"`
+	IsBot   bool             `json:"is_bot"`
+}
+
+// SlackUserProfile is a profile of SlackUser
+type SlackUserProfile struct {
+	DisplayName string `json:"display_name"`
+	RealName    string `json:"real_name"`
+}
+
+// SlackChannel is a channel of fake slack
+type SlackChannel struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// SlackAttachment is an attachment of posted message
+type SlackAttachment struct {
+	Text       string `json:"text"`
+	Color      string `json:"color"`
+	Footer     string `json:"footer"`
+	CallbackID string `json:"callback_id"`
+	Actions    []struct {
+		Name  string `json:"name"`
+		Text  string `json:"text"`
+		Value string `json:"value"`
+	} `json:"actions"`
+}
+
+// SlackMessage is a message posted by chat.postMessage
+type SlackMessage struct {
+	Channel     string
+	Text        string
+	Attachments []SlackAttachment
+}
+
+// BotID is the user id of the bot, whose name is "chihiro"
+const BotID = "UCHIHIRO"
+
+// Slack is a fake slack which serves web api under /api/ and RTM on /rtm.
+type Slack struct {
+	*httptest.Server
+	*recorder
+
+	mu        sync.Mutex
+	users     []SlackUser
+	channels  []SlackChannel
+	conns     map[*slackConn]struct{}
+	connected chan struct{}
+}
+
+type slackConn struct {
+	mu sync.Mutex
+	*websocket.Conn
+}
+
+func (c *slackConn) send(v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.WriteJSON(v)
+}
+
+// NewSlack starts fake slack which has the bot user and channels
+// "general", "tamaki" and "timestamp".
+func NewSlack() *Slack {
+	s := &Slack{
+		recorder: newRecorder(),
+		users: []SlackUser{
+			{ID: BotID, Name: "chihiro", IsBot: true},
+		},
+		channels: []SlackChannel{
+			{ID: "CGENERAL", Name: "general"},
+			{ID: "CTAMAKI", Name: "tamaki"},
+			{ID: "CTIMESTAMP", Name: "timestamp"},
+		},
+		conns:     make(map[*slackConn]struct{}),
+		connected: make(chan struct{}, 1),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/", s.api)
+	mux.HandleFunc("/rtm", s.rtm)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// APIURL returns the url which is passed to --slack-api.
+func (s *Slack) APIURL() string {
+	return s.URL + "/api/"
+}
+
+// AddUser adds the user to fake slack.
+func (s *Slack) AddUser(id, name, displayName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = append(s.users, SlackUser{
+		ID:      id,
+		Name:    name,
+		Profile: SlackUserProfile{DisplayName: displayName, RealName: displayName},
+	})
+}
+
+// AddChannel adds the channel to fake slack.
+func (s *Slack) AddChannel(id, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.channels = append(s.channels, SlackChannel{ID: id, Name: name})
+}
+
+func (s *Slack) api(w http.ResponseWriter, r *http.Request) {
+	call := s.record(r)
+	method := strings.TrimPrefix(r.URL.Path, "/api/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch method {
+	case "chat.postMessage":
+		writeJSON(w, map[string]interface{}{
+			"ok":      true,
+			"channel": call.Form.Get("channel"),
+			"ts":      fmt.Sprintf("%d.000000", call.Time.Unix()),
+		})
+	case "users.list":
+		writeJSON(w, map[string]interface{}{"ok": true, "members": s.users})
+	case "users.info":
+		for _, user := range s.users {
+			if user.ID == call.Form.Get("user") {
+				writeJSON(w, map[string]interface{}{"ok": true, "user": user})
+				return
+			}
+		}
+		writeJSON(w, map[string]interface{}{"ok": false, "error": "user_not_found"})
+	case "channels.list":
+		writeJSON(w, map[string]interface{}{"ok": true, "channels": s.channels})
+	case "im.open":
+		writeJSON(w, map[string]interface{}{
+			"ok":      true,
+			"channel": map[string]string{"id": "D" + call.Form.Get("user")},
+		})
+	case "auth.test":
+		writeJSON(w, map[string]interface{}{"ok": true, "user": "chihiro", "user_id": BotID})
+	case "rtm.start", "rtm.connect":
+		writeJSON(w, map[string]interface{}{
+			"ok":       true,
+			"url":      "ws" + strings.TrimPrefix(s.URL, "http") + "/rtm",
+			"self":     map[string]string{"id": BotID, "name": "chihiro"},
+			"team":     map[string]string{"id": "TLAB", "name": "tamaki"},
+			"users":    s.users,
+			"channels": s.channels,
+		})
+	default:
+		writeJSON(w, map[string]interface{}{"ok": false, "error": "unknown_method"})
+	}
+}
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+func (s *Slack) rtm(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	conn := &slackConn{Conn: ws}
+	s.mu.Lock()
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		ws.Close()
+	}()
+
+	if err := conn.send(map[string]string{"type": "hello"}); err != nil {
+		return
+	}
+	select {
+	case s.connected <- struct{}{}:
+	default:
+	}
+
+	for {
+		var event struct {
+			ID   int    `json:"id"`
+			Type string `json:"type"`
+		}
+		if err := ws.ReadJSON(&event); err != nil {
+			return
+		}
+		if event.Type == "ping" {
+			conn.send(map[string]interface{}{"type": "pong", "reply_to": event.ID})
+		}
+	}
+}
+
+// WaitConnected waits for the bot to connect to RTM.
+func (s *Slack) WaitConnected(timeout time.Duration) error {
+	select {
+	case <-s.connected:
+		return nil
+	case <-time.After(timeout):
+		return &TimeoutError{Path: "/rtm", Timeout: timeout}
+	}
+}
+
+// SendMessage sends the message event to bots which connect to RTM.
+func (s *Slack) SendMessage(channel, user, text string) {
+	s.mu.Lock()
+	conns := make([]*slackConn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+	for _, conn := range conns {
+		conn.send(map[string]string{
+			"type":    "message",
+			"channel": channel,
+			"user":    user,
+			"text":    text,
+			"ts":      fmt.Sprintf("%d.000000", time.Now().Unix()),
+		})
+	}
+}
+
+// Mention sends the message which mentions the bot.
+func (s *Slack) Mention(channel, user, text string) {
+	s.SendMessage(channel, user, "<@"+BotID+"> "+text)
+}
+
+// Messages returns messages posted by chat.postMessage.
+func (s *Slack) Messages() []*SlackMessage {
+	var msgs []*SlackMessage
+	for _, call := range s.CallsTo("/api/chat.postMessage") {
+		msgs = append(msgs, slackMessage(call))
+	}
+	return msgs
+}
+
+// WaitMessage waits for the message posted by chat.postMessage.
+func (s *Slack) WaitMessage(timeout time.Duration) (*SlackMessage, error) {
+	call, err := s.WaitCall("/api/chat.postMessage", timeout)
+	if err != nil {
+		return nil, err
+	}
+	return slackMessage(call), nil
+}
+
+func slackMessage(call *Call) *SlackMessage {
+	msg := &SlackMessage{
+		Channel: call.Form.Get("channel"),
+		Text:    call.Form.Get("text"),
+	}
+	if attachments := call.Form.Get("attachments"); attachments != "" {
+		json.Unmarshal([]byte(attachments), &msg.Attachments)
+	}
+	return msg
+}
@@ -0,0 +1,151 @@
+// Package testserver provides fake Slack, Mattermost and LINE servers which record API calls,
+// so labbot can be driven end-to-end without the real services.
+//
+//	slack := testserver.NewSlack()
+//	defer slack.Close()
+//	line := testserver.NewLINE()
+//	defer line.Close()
+//
+//	// run labbot with --slack-api slack.APIURL() --line-api line.URL
+//	// then post beacon webhooks made by linewebhook.NewWebhookRequest and wait for messages
+//	msg, err := slack.WaitMessage(5 * time.Second)
+package testserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Call is a recorded API call
+type Call struct {
+	Method string
+	Path   string
+	Header http.Header
+	// Form is parsed query and form body, it is used by slack web api
+	Form url.Values
+	// Body is raw request body
+	Body []byte
+	Time time.Time
+}
+
+// JSON decodes the request body to v.
+func (c *Call) JSON(v interface{}) error {
+	return json.Unmarshal(c.Body, v)
+}
+
+// recorder records API calls, and notifies them to waiters.
+type recorder struct {
+	mu    sync.Mutex
+	calls []*Call
+	// waited is the number of calls which WaitCall has returned by path
+	waited map[string]int
+	// recorded is closed and replaced when a call is recorded
+	recorded chan struct{}
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		waited:   make(map[string]int),
+		recorded: make(chan struct{}),
+	}
+}
+
+func (r *recorder) record(req *http.Request) *Call {
+	body, _ := ioutil.ReadAll(req.Body)
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	call := &Call{
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Header: req.Header,
+		Body:   body,
+		Time:   time.Now(),
+	}
+	if req.ParseForm() == nil {
+		call.Form = req.Form
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	r.mu.Lock()
+	r.calls = append(r.calls, call)
+	close(r.recorded)
+	r.recorded = make(chan struct{})
+	r.mu.Unlock()
+	return call
+}
+
+// Calls returns all recorded calls.
+func (r *recorder) Calls() []*Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Call(nil), r.calls...)
+}
+
+// CallsTo returns recorded calls to the path.
+func (r *recorder) CallsTo(path string) []*Call {
+	var calls []*Call
+	for _, call := range r.Calls() {
+		if call.Path == path {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// Reset forgets recorded calls.
+func (r *recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = nil
+	r.waited = make(map[string]int)
+}
+
+// WaitCall waits for the next call to the path which is made after the last Reset.
+// Each path has its own cursor, so waiting for a path doesn't skip calls to the others,
+// and the calls which are made before WaitCall are returned in order.
+func (r *recorder) WaitCall(path string, timeout time.Duration) (*Call, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		r.mu.Lock()
+		n := 0
+		for _, call := range r.calls {
+			if call.Path != path {
+				continue
+			}
+			if n == r.waited[path] {
+				r.waited[path]++
+				r.mu.Unlock()
+				return call, nil
+			}
+			n++
+		}
+		recorded := r.recorded
+		r.mu.Unlock()
+
+		select {
+		case <-recorded:
+		case <-timer.C:
+			return nil, &TimeoutError{Path: path, Timeout: timeout}
+		}
+	}
+}
+
+// TimeoutError is returned when the expected call is not made.
+type TimeoutError struct {
+	Path    string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return "testserver: no call to " + e.Path + " in " + e.Timeout.String()
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,48 @@
+package testserver
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWaitCall(t *testing.T) {
+	r := newRecorder()
+	r.record(httptest.NewRequest("POST", "/a", nil))
+	r.record(httptest.NewRequest("POST", "/b", nil))
+	r.record(httptest.NewRequest("POST", "/a", nil))
+
+	// Waiting for /b doesn't consume calls to /a
+	if call, err := r.WaitCall("/b", time.Second); err != nil || call.Path != "/b" {
+		t.Fatalf("WaitCall(/b) = %v, %v", call, err)
+	}
+	first, err := r.WaitCall("/a", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := r.WaitCall("/a", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Error("WaitCall returned the same call twice")
+	}
+	if _, err := r.WaitCall("/a", 10*time.Millisecond); err == nil {
+		t.Error("WaitCall should time out without new calls")
+	}
+
+	// The call which is made while waiting
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		r.record(httptest.NewRequest("POST", "/a", nil))
+	}()
+	if _, err := r.WaitCall("/a", time.Second); err != nil {
+		t.Errorf("WaitCall for the later call = %v", err)
+	}
+
+	r.Reset()
+	r.record(httptest.NewRequest("POST", "/b", nil))
+	if _, err := r.WaitCall("/b", time.Second); err != nil {
+		t.Errorf("WaitCall after Reset = %v", err)
+	}
+}
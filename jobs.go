@@ -0,0 +1,256 @@
+package labbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/robfig/cron"
+	"go.uber.org/zap"
+)
+
+// jobsKey is the prefix of lists of jobRun, e.g. "chihiro:jobs:progress".
+// The newest run is at the head.
+const jobsKey = key + ":jobs"
+
+// lastSuccessKey is the hash of job name and the start time of the last successful run
+const lastSuccessKey = jobsKey + ":last-success"
+
+// maxJobRuns is the number of runs kept for each job
+const maxJobRuns = 30
+
+const (
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+	outcomeSkipped = "skipped"
+)
+
+// jobRun is a record of cron job execution
+type jobRun struct {
+	Job     string    `json:"job"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Outcome string    `json:"outcome"`
+	Error   string    `json:"error,omitempty"`
+	// CatchUp is true when the run is missed during downtime
+	CatchUp bool `json:"catch_up,omitempty"`
+}
+
+// runJob runs the cron job, records the run, and alerts administrators
+// when the job fails --job-alert times in a row.
+func (l *labbot) runJob(job cronJob) {
+	l.runJobOnce(job, false)
+}
+
+func (l *labbot) runJobOnce(job cronJob, catchUp bool) {
+	l.work.Add(1) // wait on shutdown
+	defer l.work.Done()
+
+	run := &jobRun{Job: job.name, Start: time.Now(), Outcome: outcomeSuccess, CatchUp: catchUp}
+	err := observeCron(job.name, func() (err error) { // metrics.go
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return job.run(l)
+	})
+	run.End = time.Now()
+	if err != nil {
+		run.Outcome = outcomeFailure
+		run.Error = err.Error()
+		l.Error("cron job failed", zap.String("job", job.name), zap.Error(err))
+	}
+	if err := l.recordJobRunOf(job, run); err != nil {
+		l.Warn("Failed to record cron job", zap.String("job", job.name), zap.Error(err))
+		return
+	}
+	if run.Outcome == outcomeSuccess {
+		if err := l.Redis.HSet(lastSuccessKey, job.name, run.Start.Format(time.RFC3339)).Err(); err != nil {
+			l.Warn("Failed to record last success of cron job", zap.String("job", job.name), zap.Error(err))
+		}
+	}
+	if run.Outcome == outcomeSuccess || l.JobAlert <= 0 {
+		return
+	}
+	failures, err := l.consecutiveFailures(job.name)
+	if err != nil {
+		l.Warn("Failed to count failures of cron job", zap.String("job", job.name), zap.Error(err))
+		return
+	}
+	// Alert only once until the job succeeds
+	if failures == l.JobAlert {
+		l.alertJobFailure(run, failures)
+	}
+}
+
+// recordJobRunOf records the run unless the job is quiet and the run is
+// just one of successes. The success after failures ends the failure streak.
+func (l *labbot) recordJobRunOf(job cronJob, run *jobRun) error {
+	if job.quiet && run.Outcome == outcomeSuccess {
+		runs, err := l.jobRuns(job.name, 1)
+		if err != nil {
+			return err
+		}
+		if len(runs) == 0 || runs[0].Outcome != outcomeFailure {
+			return nil
+		}
+	}
+	return l.recordJobRun(run)
+}
+
+func (l *labbot) recordJobRun(run *jobRun) error {
+	serialized, err := json.Marshal(run)
+	if err != nil {
+		return errors.Wrap(err, "JSON Marshal error")
+	}
+	listKey := jobsKey + ":" + run.Job
+	if err := l.Redis.LPush(listKey, string(serialized)).Err(); err != nil {
+		return errors.Wrap(err, "Could not push job run to redis")
+	}
+	return l.Redis.LTrim(listKey, 0, maxJobRuns-1).Err()
+}
+
+// jobRuns returns the last n runs of the job, the newest first.
+func (l *labbot) jobRuns(name string, n int) ([]*jobRun, error) {
+	list, err := l.Redis.LRange(jobsKey+":"+name, 0, int64(n-1)).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get job runs")
+	}
+	runs := make([]*jobRun, 0, len(list))
+	for _, serialized := range list {
+		run := new(jobRun)
+		if err := json.Unmarshal([]byte(serialized), run); err != nil {
+			l.Warn("Could not unmarshal job run", zap.Error(err))
+			continue
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+func (l *labbot) consecutiveFailures(name string) (int, error) {
+	runs, err := l.jobRuns(name, maxJobRuns)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, run := range runs {
+		if run.Outcome != outcomeFailure {
+			break
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (l *labbot) alertJobFailure(run *jobRun, failures int) {
+	data := &messageData{Name: run.Job, Count: failures, Value: run.Error}
+	for _, admin := range l.Admins {
+		adminID, err := l.Chat.FindUserID(admin)
+		if err != nil {
+			l.Warn("Failed to find admin", zap.Error(err))
+			continue
+		}
+		text := l.messageIn(l.localeOfChatUser(adminID), "jobs.alert", data) // locale.go
+		l.sendDirectMessage(adminID, &ChatMessage{Text: text})
+	}
+}
+
+// jobStatus is the status of cron job for "/api/v1/jobs"
+type jobStatus struct {
+	Name     string    `json:"name"`
+	Spec     string    `json:"spec"`
+	Next     time.Time `json:"next"`
+	Failures int       `json:"consecutive_failures"`
+	LastRuns []*jobRun `json:"last_runs"`
+	// LastSuccess is newer than LastRuns for quiet jobs
+	LastSuccess time.Time `json:"last_success"`
+}
+
+func (l *labbot) jobStatuses(now time.Time, runs int) ([]*jobStatus, error) {
+	statuses := make([]*jobStatus, 0, len(cronJobs))
+	for _, job := range cronJobs {
+		schedule, err := cron.Parse(job.spec)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid spec of %s", job.name)
+		}
+		last, err := l.jobRuns(job.name, runs)
+		if err != nil {
+			return nil, err
+		}
+		failures, err := l.consecutiveFailures(job.name)
+		if err != nil {
+			return nil, err
+		}
+		success, err := l.lastSuccess(job.name) // catchup.go
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, &jobStatus{
+			Name:        job.name,
+			Spec:        job.spec,
+			Next:        schedule.Next(now),
+			Failures:    failures,
+			LastRuns:    last,
+			LastSuccess: success,
+		})
+	}
+	return statuses, nil
+}
+
+// jobsAPI is "/api/v1/jobs" handler
+func (l *labbot) jobsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		l.Error("Invalid method", zap.String("method", r.Method), zap.String("expected", "GET"))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	statuses, err := l.jobStatuses(time.Now(), 5)
+	if err != nil {
+		l.Error("Failed to get job statuses", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// jobsMessage returns last runs and next times of cron jobs for "@chihiro jobs" in the locale.
+func (l *labbot) jobsMessage(locale string) string {
+	statuses, err := l.jobStatuses(time.Now(), 1)
+	if err != nil {
+		l.Error("Failed to get job statuses", zap.Error(err))
+		return l.messageIn(locale, "jobs.failed", &messageData{})
+	}
+	lines := make([]string, 0, len(statuses))
+	for _, status := range statuses {
+		last := l.messageIn(locale, "jobs.never", &messageData{})
+		if len(status.LastRuns) == 0 || status.LastRuns[0].Start.Before(status.LastSuccess) {
+			if !status.LastSuccess.IsZero() {
+				data := &messageData{Time: formatTime(locale, status.LastSuccess)}
+				last = l.messageIn(locale, "jobs.last-success", data)
+			}
+		} else {
+			run := status.LastRuns[0]
+			data := &messageData{Time: formatTime(locale, run.Start), Count: status.Failures, Value: run.Error}
+			switch run.Outcome {
+			case outcomeFailure:
+				last = l.messageIn(locale, "jobs.last-failure", data)
+			case outcomeSkipped:
+				last = l.messageIn(locale, "jobs.last-skipped", data)
+			default:
+				last = l.messageIn(locale, "jobs.last-success", data)
+			}
+		}
+		lines = append(lines, l.messageIn(locale, "jobs.job", &messageData{
+			Name:  status.Name,
+			Time:  formatTime(locale, status.Next),
+			Value: last,
+		}))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,48 @@
+package labbot
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Code-Hex/labbot/internal/testserver"
+)
+
+func TestRunQuietJob(t *testing.T) {
+	slack := testserver.NewSlack()
+	defer slack.Close()
+	line := testserver.NewLINE()
+	defer line.Close()
+	l, _ := newTestLabbot(t, slack, line)
+
+	var err error
+	job := cronJob{name: "last-out", spec: "0 * * * * *", run: func(*labbot) error { return err }, quiet: true}
+	outcomes := func() []string {
+		runs, _ := l.jobRuns(job.name, maxJobRuns)
+		var outcomes []string
+		for _, run := range runs {
+			outcomes = append(outcomes, run.Outcome)
+		}
+		return outcomes
+	}
+
+	l.runJobOnce(job, false)
+	if got := outcomes(); len(got) != 0 {
+		t.Errorf("runs = %v, want successes not recorded", got)
+	}
+	if last, _ := l.lastSuccess(job.name); last.IsZero() {
+		t.Error("the last success is not recorded")
+	}
+
+	err = errors.New("redis is down")
+	l.runJobOnce(job, false)
+	err = nil
+	l.runJobOnce(job, false)
+	l.runJobOnce(job, false)
+	// Only the first success after the failure is recorded to end the streak
+	if got := outcomes(); len(got) != 2 || got[0] != outcomeSuccess || got[1] != outcomeFailure {
+		t.Errorf("runs = %v, want [success failure]", got)
+	}
+	if failures, _ := l.consecutiveFailures(job.name); failures != 0 {
+		t.Errorf("consecutive failures = %d, want 0", failures)
+	}
+}
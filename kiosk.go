@@ -0,0 +1,282 @@
+package labbot
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	pinKey        = key + ":pin"
+	pinFailureKey = key + ":pin_failure"
+	// kioskTokenKey is the hash of member name and the nonce of the latest QR token,
+	// issuing a new token revokes the old one.
+	kioskTokenKey = key + ":kiosk_token"
+
+	maxPinFailure = 5
+	// maxMemberPinFailure is larger than maxPinFailure, since mistakes of others
+	// lock out the member, while it stops attackers who change their address.
+	maxMemberPinFailure = 10
+	pinLockTime         = 10 * time.Minute
+
+	kioskTokenLifetime = 180 * 24 * time.Hour
+)
+
+// pinCost is the cost of bcrypt, which makes brute force of PINs in redis slow
+var pinCost = bcrypt.DefaultCost
+
+// hashPin returns the bcrypt hash of the PIN, which has the salt of its own.
+func hashPin(pin string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(pin), pinCost)
+	if err != nil {
+		return "", errors.Wrap(err, "Could not hash pin")
+	}
+	return string(hashed), nil
+}
+
+// legacyHashPin is the unsalted hash which was stored before bcrypt.
+func legacyHashPin(name, pin string) string {
+	sum := sha256.Sum256([]byte(name + ":" + pin))
+	return hex.EncodeToString(sum[:])
+}
+
+// matchPin reports whether the PIN matches hashed, and whether hashed is legacy.
+func matchPin(hashed, name, pin string) (ok, legacy bool) {
+	if !strings.HasPrefix(hashed, "$2") {
+		return hmac.Equal([]byte(hashed), []byte(legacyHashPin(name, pin))), true
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(pin)) == nil, false
+}
+
+// setPin registers the PIN of the chat user for the kiosk.
+func (l *labbot) setPin(userID, pin string) string {
+	locale := l.localeOfChatUser(userID) // locale.go
+	if len(pin) < 4 {
+		return l.messageIn(locale, "pin.short", &messageData{})
+	}
+	name, err := l.memberName(userID)
+	if err != nil {
+		l.Error("Could not find member name", zap.Error(err))
+		return l.messageIn(locale, "member.unknown", &messageData{})
+	}
+	hashed, err := hashPin(pin)
+	if err != nil {
+		l.Error("Could not hash pin", zap.Error(err))
+		return l.messageIn(locale, "pin.failed", &messageData{})
+	}
+	if err := l.Redis.HSet(pinKey, name, hashed).Err(); err != nil {
+		l.Error("Could not set pin to redis", zap.Error(err))
+		return l.messageIn(locale, "pin.failed", &messageData{})
+	}
+	return l.messageIn(locale, "pin.set", &messageData{Name: name})
+}
+
+// verifyPin checks the PIN, and locks the client (e.g. the kiosk) for a while
+// when the PIN is mistaken too many times. The member is also locked after
+// more mistakes, for attackers who change their address.
+func (l *labbot) verifyPin(client, name, pin string) error {
+	clientKey := pinFailureKey + ":" + client
+	memberKey := pinFailureKey + ":member:" + name
+	for key, max := range map[string]int64{clientKey: maxPinFailure, memberKey: maxMemberPinFailure} {
+		failure, err := l.Redis.Get(key).Int64()
+		if err != nil && err != redis.Nil {
+			return errors.Wrap(err, "Could not get pin failure count")
+		}
+		if failure >= max {
+			return newMessageError("pin.locked", &messageData{})
+		}
+	}
+	hashed, err := l.Redis.HGet(pinKey, name).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrap(err, "Could not get pin")
+	}
+	var ok, legacy bool
+	if err == nil {
+		ok, legacy = matchPin(hashed, name, pin)
+	}
+	if !ok {
+		for _, key := range []string{clientKey, memberKey} {
+			l.Redis.Incr(key)
+			l.Redis.Expire(key, pinLockTime)
+		}
+		if err == redis.Nil {
+			return newMessageError("pin.not-set", &messageData{})
+		}
+		return newMessageError("pin.wrong", &messageData{})
+	}
+	l.Redis.Del(clientKey, memberKey)
+	if legacy {
+		// Replace the unsalted hash now that the PIN is known
+		if hashed, err := hashPin(pin); err == nil {
+			if err := l.Redis.HSet(pinKey, name, hashed).Err(); err != nil {
+				l.Warn("Could not rehash pin", zap.String("name", name), zap.Error(err))
+			}
+		}
+	}
+	return nil
+}
+
+// clientAddr returns the remote IP of the request, which identifies the kiosk.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func signKiosk(payload string) string {
+	mac := hmac.New(sha256.New, []byte(kioskSecret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issueKioskToken returns the token for QR code, format is
+// "<base64(name)>.<issued at>.<nonce>.<signature>".
+// The nonce is stored as the version of the member's token, so the old token is revoked.
+func (l *labbot) issueKioskToken(name string, now time.Time) (string, error) {
+	nonce := newRandomID() // subscription.go
+	if err := l.Redis.HSet(kioskTokenKey, name, nonce).Err(); err != nil {
+		return "", errors.Wrap(err, "Could not set kiosk token to redis")
+	}
+	payload := base64.RawURLEncoding.EncodeToString([]byte(name)) + "." +
+		strconv.FormatInt(now.Unix(), 10) + "." + nonce
+	return payload + "." + signKiosk(payload), nil
+}
+
+// verifyKioskToken returns the name of member who owns the token.
+// The token is rejected if it is expired or a newer one has been issued.
+func (l *labbot) verifyKioskToken(token string, now time.Time) (string, error) {
+	if kioskSecret == "" {
+		return "", newMessageError("qr.unavailable", &messageData{})
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return "", newMessageError("qr.unreadable", &messageData{})
+	}
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(parts[3]), []byte(signKiosk(payload))) {
+		return "", newMessageError("qr.invalid", &messageData{})
+	}
+	name, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", newMessageError("qr.unreadable", &messageData{})
+	}
+	issuedAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", newMessageError("qr.unreadable", &messageData{})
+	}
+	if now.Sub(time.Unix(issuedAt, 0)) > kioskTokenLifetime {
+		return "", newMessageError("qr.expired", &messageData{})
+	}
+	nonce, err := l.Redis.HGet(kioskTokenKey, string(name)).Result()
+	if err != nil && err != redis.Nil {
+		return "", errors.Wrap(err, "Could not get kiosk token")
+	}
+	if !hmac.Equal([]byte(nonce), []byte(parts[2])) {
+		return "", newMessageError("qr.revoked", &messageData{})
+	}
+	return string(name), nil
+}
+
+// kioskToken replies the token for QR code to the chat user.
+func (l *labbot) kioskToken(userID string) string {
+	locale := l.localeOfChatUser(userID) // locale.go
+	if kioskSecret == "" {
+		return l.messageIn(locale, "qr.disabled", &messageData{})
+	}
+	name, err := l.memberName(userID)
+	if err != nil {
+		l.Error("Could not find member name", zap.Error(err))
+		return l.messageIn(locale, "member.unknown", &messageData{})
+	}
+	token, err := l.issueKioskToken(name, time.Now())
+	if err != nil {
+		l.Error("Failed to issue kiosk token", zap.Error(err))
+		return l.messageIn(locale, "qr.failed", &messageData{})
+	}
+	return l.messageIn(locale, "qr.token", &messageData{Name: name, Value: token})
+}
+
+type checkinRequest struct {
+	Name   string `json:"name"`
+	Pin    string `json:"pin"`
+	Token  string `json:"token"`
+	Action string `json:"action"` // "in", "out" or "toggle" (default)
+}
+
+type checkinResponse struct {
+	Name    string `json:"name,omitempty"`
+	Inlab   bool   `json:"in_lab"`
+	Message string `json:"message"`
+}
+
+// "/api/v1/checkin" handler
+func (l *labbot) kioskCheckin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		l.Error("Invalid method", zap.String("method", r.Method), zap.String("expected", "POST"))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req checkinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		l.Error("Failed to decode json message from kiosk", zap.Error(err))
+		writeCheckin(w, http.StatusBadRequest, &checkinResponse{Message: l.message("kiosk.bad-request", &messageData{})})
+		return
+	}
+
+	name := req.Name
+	if req.Token != "" {
+		var err error
+		name, err = l.verifyKioskToken(req.Token, time.Now())
+		if err != nil {
+			l.Warn("Failed to verify kiosk token", zap.Error(err))
+			// The kiosk is shared by members, so it speaks in --locale
+			writeCheckin(w, http.StatusUnauthorized, &checkinResponse{Message: l.errorMessage(l.Locale, err, "kiosk.failed")})
+			return
+		}
+	} else if err := l.verifyPin(clientAddr(r), name, req.Pin); err != nil {
+		l.Warn("Failed to verify pin", zap.String("name", name), zap.Error(err))
+		writeCheckin(w, http.StatusUnauthorized, &checkinResponse{Name: name, Message: l.errorMessage(l.Locale, err, "kiosk.failed")})
+		return
+	}
+
+	var inlab bool
+	switch req.Action {
+	case "in":
+		inlab = true
+	case "out":
+		inlab = false
+	case "", "toggle":
+		inlab = !isAlready(name)
+	default:
+		writeCheckin(w, http.StatusBadRequest, &checkinResponse{Name: name, Message: l.message("kiosk.bad-action", &messageData{})})
+		return
+	}
+
+	msg := l.recordPresence(name, inlab, time.Now(), sourceKiosk)
+	writeCheckin(w, http.StatusOK, &checkinResponse{
+		Name:    name,
+		Inlab:   isAlready(name),
+		Message: msg,
+	})
+}
+
+func writeCheckin(w http.ResponseWriter, status int, res *checkinResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,72 @@
+package labbot
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Code-Hex/labbot/internal/testserver"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerifyPin(t *testing.T) {
+	cost := pinCost
+	pinCost = bcrypt.MinCost
+	defer func() { pinCost = cost }()
+
+	slack := testserver.NewSlack()
+	defer slack.Close()
+	slack.AddUser("UALICE", "alice", "ありす")
+	line := testserver.NewLINE()
+	defer line.Close()
+	l, _ := newTestLabbot(t, slack, line)
+
+	l.setPin("UALICE", "1234")
+	hashed, err := l.Redis.HGet(pinKey, "ありす").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hashed, "$2") {
+		t.Errorf("stored pin = %q, want bcrypt", hashed)
+	}
+	if err := l.verifyPin("10.0.0.1", "ありす", "1234"); err != nil {
+		t.Errorf("verifyPin() = %v", err)
+	}
+	if err := l.verifyPin("10.0.0.1", "ありす", "4321"); err == nil {
+		t.Error("wrong pin is accepted")
+	}
+
+	// The member is locked even if attackers change their address
+	for i := 0; i < maxMemberPinFailure; i++ {
+		l.verifyPin(fmt.Sprintf("10.0.1.%d", i), "ありす", "0000")
+	}
+	err = l.verifyPin("10.0.2.1", "ありす", "1234")
+	if e, ok := err.(*messageError); !ok || e.id != "pin.locked" {
+		t.Errorf("verifyPin() of the locked member = %v, want pin.locked", err)
+	}
+}
+
+func TestVerifyLegacyPin(t *testing.T) {
+	cost := pinCost
+	pinCost = bcrypt.MinCost
+	defer func() { pinCost = cost }()
+
+	slack := testserver.NewSlack()
+	defer slack.Close()
+	line := testserver.NewLINE()
+	defer line.Close()
+	l, _ := newTestLabbot(t, slack, line)
+
+	// PIN which was stored before bcrypt
+	l.Redis.HSet(pinKey, "ありす", legacyHashPin("ありす", "1234"))
+	if err := l.verifyPin("10.0.0.1", "ありす", "1234"); err != nil {
+		t.Fatalf("verifyPin() = %v", err)
+	}
+	hashed, _ := l.Redis.HGet(pinKey, "ありす").Result()
+	if !strings.HasPrefix(hashed, "$2") {
+		t.Errorf("stored pin = %q, want rehashed by bcrypt", hashed)
+	}
+	if err := l.verifyPin("10.0.0.1", "ありす", "1234"); err != nil {
+		t.Errorf("verifyPin() after rehash = %v", err)
+	}
+}
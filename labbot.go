@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"time"
 
 	"syscall"
@@ -17,9 +18,10 @@ import (
 	"github.com/go-redis/redis"
 	rotatelogs "github.com/lestrrat/go-file-rotatelogs"
 	"github.com/lestrrat/go-server-starter/listener"
+	"github.com/line/line-bot-sdk-go/linebot"
 	"github.com/line/line-bot-sdk-go/linebot/httphandler"
-	"github.com/nlopes/slack"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/robfig/cron"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -35,6 +37,14 @@ var (
 	channelSecret     = os.Getenv("CHANNEL_SECRET")
 	channelToken      = os.Getenv("CHANNEL_TOKEN")
 	verificationToken = os.Getenv("VERIFICATION_TOKEN")
+	kioskSecret       = os.Getenv("KIOSK_SECRET")
+
+	mattermostURL          = os.Getenv("MATTERMOST_URL")
+	mattermostToken        = os.Getenv("MATTERMOST_TOKEN")
+	mattermostTeam         = os.Getenv("MATTERMOST_TEAM")
+	mattermostHookToken    = os.Getenv("MATTERMOST_HOOK_TOKEN")
+	mattermostCommandToken = os.Getenv("MATTERMOST_COMMAND_TOKEN")
+	mattermostActionSecret = os.Getenv("MATTERMOST_ACTION_SECRET")
 )
 
 type labbot struct {
@@ -42,9 +52,29 @@ type labbot struct {
 	*http.Server
 	*zap.Logger
 	*cron.Cron
-	*slack.Client
+	Chat       ChatAdapter
+	LINE       *linebot.Client
 	Redis      *redis.Client
 	waitSignal chan os.Signal
+
+	// cronRunning is 1 while cron jobs are scheduled, see /readyz
+	cronRunning int32
+	persona     *persona // persona.go
+
+	// leader is 1 while this instance is the leader, see leader.go
+	leader       int32
+	stopCampaign chan struct{}
+	// campaignDone is closed when the campaign has stopped cron jobs
+	campaignDone chan struct{}
+	// work is in-flight LINE events, mentions and cron jobs
+	work sync.WaitGroup
+	// presenceReset is the subscription of the reset by the CLI, see line-beacon.go
+	presenceReset *redis.PubSub
+	// richMenuOnce sets up the rich menu once on the leader, see leader.go
+	richMenuOnce sync.Once
+	// chatReady and lineReady cache checks of /readyz, see healthckeck.go
+	chatReady checkCache
+	lineReady checkCache
 }
 
 func (l *labbot) registerHandlers() (http.Handler, error) {
@@ -52,17 +82,26 @@ func (l *labbot) registerHandlers() (http.Handler, error) {
 
 	// Normal
 	mux.HandleFunc("/healthcheck", healthCheck) // healthcheck.go
-	mux.HandleFunc("/whoisthere", whoIsThere)   // line-beacon.go
+	mux.HandleFunc("/healthz", healthCheck)     // healthcheck.go
+	mux.HandleFunc("/readyz", l.readyCheck)     // healthcheck.go
+	mux.HandleFunc("/whoisthere", l.whoIsThere) // line-beacon.go
+	mux.Handle("/metrics", promhttp.Handler())
+
+	// Kiosk
+	mux.HandleFunc("/api/v1/checkin", l.kioskCheckin) // kiosk.go
 
-	// slack webhook
-	mux.HandleFunc("/slack_participate", l.ServeHTTP)
+	// Cron jobs
+	mux.HandleFunc("/api/v1/jobs", l.jobsAPI) // jobs.go
+
+	// Chat webhook, e.g. "/slack_participate", "/slack_command"
+	l.Chat.RegisterHandlers(mux, l) // chat.go
 
 	// LINE Webhook
 	webhook, err := httphandler.New(channelSecret, channelToken)
 	if err != nil {
 		return nil, exit.MakeSoftWare(err)
 	}
-	webhook.HandleEvents(l.lineAPIInit())
+	webhook.HandleEvents(l.lineAPIInit()) // line-beacon.go
 	webhook.HandleError(func(err error, r *http.Request) {
 		l.Warn("LINEBot handler error", zap.Error(err))
 	})
@@ -80,7 +119,7 @@ func (l *labbot) registerHandlers() (http.Handler, error) {
 	fs := http.FileServer(http.Dir(dir))
 	mux.Handle("/", fs)
 
-	return mux, nil
+	return observeHTTP(mux), nil // metrics.go
 }
 
 func exists(path string) (bool, error) {
@@ -95,20 +134,19 @@ func exists(path string) (bool, error) {
 }
 
 func New() *labbot {
-	sigch := make(chan os.Signal)
+	// buffered for the second signal which forces exit
+	sigch := make(chan os.Signal, 1)
 	signal.Notify(
 		sigch,
 		syscall.SIGINT,
 		syscall.SIGTERM,
 	)
 	return &labbot{
-		Server: new(http.Server),
-		Cron:   cron.New(),
-		Client: slack.New(slackToken),
-		Redis: redis.NewClient(&redis.Options{
-			Addr: "127.0.0.1:6379",
-		}),
-		waitSignal: sigch,
+		Server:       new(http.Server),
+		Cron:         cron.New(),
+		waitSignal:   sigch,
+		stopCampaign: make(chan struct{}),
+		campaignDone: make(chan struct{}),
 	}
 }
 
@@ -126,6 +164,18 @@ func (l *labbot) Run() int {
 }
 
 func (l *labbot) run() error {
+	args, err := parseOptions(&l.Options, os.Args[1:])
+	if err != nil {
+		return errors.Wrap(err, "Failed to parse command line args")
+	}
+	switch l.command {
+	case "", "serve":
+	case "simulate":
+		return l.SimulateCommand.run() // simulate.go
+	default:
+		return l.runCommand(args) // cli.go
+	}
+
 	if err := l.prepare(); err != nil {
 		return err
 	}
@@ -137,39 +187,83 @@ func (l *labbot) run() error {
 }
 
 func (l *labbot) prepare() error {
-	_, err := parseOptions(&l.Options, os.Args[1:])
+	if err := l.setup(); err != nil {
+		return err
+	}
+
+	bot, err := l.newLINEClient() // line-client.go
 	if err != nil {
-		return errors.Wrap(err, "Failed to parse command line args")
+		return exit.MakeSoftWare(err)
+	}
+	l.LINE = bot
+	l.Chat = l.newChatAdapter()
+
+	handler, err := l.registerHandlers()
+	if err != nil {
+		return errors.Wrap(err, "Failed to register http handlers")
 	}
+	l.Handler = handler
+	l.registerCronHandlers()
+
+	return nil
+}
 
+// setup prepares the logger and the storage which are shared with subcommands.
+func (l *labbot) setup() error {
 	logger, err := setupLogger(
 		zap.AddCaller(),
 		zap.AddStacktrace(zap.ErrorLevel),
 	)
 	if err != nil {
-		errors.Wrap(err, "Failed to construct zap")
+		return errors.Wrap(err, "Failed to construct zap")
 	}
 	l.Logger = logger
 
-	handler, err := l.registerHandlers()
+	l.Redis = redis.NewClient(&redis.Options{
+		Addr: l.RedisAddr,
+	})
+	observeRedis(l.Redis) // metrics.go
+
+	persona, err := loadPersona(l.Persona) // persona.go
 	if err != nil {
-		return errors.Wrap(err, "Failed to register http handlers")
+		return exit.MakeDataErr(err)
 	}
-	l.Handler = handler
-	l.registerCronHandlers()
-
+	l.persona = persona
 	return nil
 }
 
+func (l *labbot) newChatAdapter() ChatAdapter {
+	var chat ChatAdapter
+	switch l.ChatPlatform {
+	case "mattermost":
+		chat = newMattermostAdapter(&mattermostConfig{
+			URL:          mattermostURL,
+			Token:        mattermostToken,
+			Team:         mattermostTeam,
+			HookToken:    mattermostHookToken,
+			CommandToken: mattermostCommandToken,
+			PublicURL:    l.PublicURL,
+			ActionSecret: mattermostActionSecret,
+			Work:         &l.work,
+		}, http.DefaultClient, l.Logger) // mattermost.go
+	default:
+		chat = newSlackAdapter(slackToken, verificationToken, l.SlackAPI, l.persona.Name, l.Logger) // slack.go
+	}
+	chat = &observedChat{ChatAdapter: chat} // metrics.go
+	if l.DryRun {
+		chat = &dryRunChat{ChatAdapter: chat, Logger: l.Logger} // dryrun.go
+	}
+	return chat
+}
+
 func (l *labbot) registerCronHandlers() {
 	l.Info("register cron")
 	// Please check cron.go
-	l.AddFunc("0 30 18 * * *", l.isThereProgress)
-	l.AddFunc("0 0 10 * * 5", l.noticeSeminar)
-	l.AddFunc("0 0 15 * * 1,3,5", l.noticeClean)
-	l.AddFunc("0 0 17 * * 3", l.noticeDayAfterTomorrow)
-
-	l.Start() // start cron job
+	for _, job := range cronJobs {
+		job := job
+		l.AddFunc(job.spec, func() { l.runJob(job) }) // jobs.go
+	}
+	// cron is started by the leader, see leader.go
 }
 
 func setupLogger(opts ...zap.Option) (*zap.Logger, error) {
@@ -220,6 +314,9 @@ func parseOptions(opts *Options, argv []string) ([]string, error) {
 	if opts.Version {
 		return nil, exit.MakeUsage(errors.New(msg))
 	}
+	if err := opts.validate(); err != nil {
+		return nil, exit.MakeUsage(err)
+	}
 
 	return o, nil
 }
@@ -248,7 +345,16 @@ func (l *labbot) listen() (net.Listener, error) {
 }
 
 func (l *labbot) serve(li net.Listener) error {
-	go l.rtmRun()
+	go l.campaign(l.stopCampaign) // leader.go
+	go l.listenChat()
+	pubsub, err := l.subscribePresenceReset() // line-beacon.go
+	if err != nil {
+		l.Warn("Failed to subscribe the presence reset", zap.Error(err))
+	}
+	l.presenceReset = pubsub
+	if l.NetworkFile != "" || l.NetworkCommand != "" {
+		go l.collectNetwork() // network.go
+	}
 	go func() {
 		if err := l.Serve(li); err != nil {
 			l.Warn("Server is stopped", zap.Error(err))
@@ -257,35 +363,78 @@ func (l *labbot) serve(li net.Listener) error {
 	return l.shutdown()
 }
 
-func (l *labbot) rtmRun() {
-	botID, err := l.findUserID(botName)
-	if err != nil {
-		l.Error("Could not to get the bot id", zap.Error(err))
+func (l *labbot) listenChat() {
+	if err := l.Chat.Listen(&leaderHandler{l}); err != nil { // leader.go
+		l.Error("Stopped to listen chat", zap.String("chat", l.Chat.Name()), zap.Error(err))
 	}
+}
 
-	rtm := l.NewRTM()
-	go rtm.ManageConnection()
+// shutdown waits for the signal and stops in order. The second signal forces exit.
+func (l *labbot) shutdown() error {
+	sig := <-l.waitSignal
+	l.Info("shutting down", zap.String("signal", sig.String()), zap.Duration("timeout", l.ShutdownTimeout))
+	go func() {
+		sig := <-l.waitSignal
+		l.Warn("forced to exit", zap.String("signal", sig.String()))
+		l.Sync()
+		os.Exit(1)
+	}()
 
-	reply := make(chan *slack.MessageEvent)
-	defer close(reply)
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), l.ShutdownTimeout)
+	defer cancel()
+
+	// Followers may have stale presence, so only the leader persists it at last.
+	// It's checked before the campaign stops, which demotes this instance.
+	leader := l.isLeader()
+
+	// Stop new work: cron jobs, mentions and webhooks.
+	// Cron jobs are stopped by the campaign, since cron cannot be stopped concurrently.
+	close(l.stopCampaign)
+	select {
+	case <-l.campaignDone:
+	case <-ctx.Done():
+		l.Warn("timed out to stop the campaign")
+	}
+	if err := l.Chat.Close(); err != nil {
+		l.Warn("Failed to close chat", zap.String("chat", l.Chat.Name()), zap.Error(err))
+	}
+	serverErr := l.Shutdown(ctx)
+	if serverErr != nil {
+		l.Warn("Failed to shutdown server gracefully", zap.Error(serverErr))
+	}
 
-	go l.msgEvent(rtm, botID, reply)
+	// Wait in-flight LINE events, mentions and cron jobs
+	drained := make(chan struct{})
+	go func() {
+		l.work.Wait()
+		close(drained)
+	}()
+	completed := true
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		completed = false
+		l.Warn("timed out to wait in-flight work")
+	}
 
-	for msg := range rtm.IncomingEvents {
-		switch ev := msg.Data.(type) {
-		case *slack.MessageEvent:
-			reply <- ev
-		case *slack.RTMError:
-			l.Error("slack rtm error", zap.String("Error", ev.Error()))
-		case *slack.InvalidAuthEvent:
-			l.Error("Invalid credentials")
-			return
-		}
+	// Persist state
+	if leader {
+		l.storePeopleData() // line-beacon.go
+	}
+	if l.presenceReset != nil {
+		l.presenceReset.Close()
+	}
+	if err := l.Redis.Close(); err != nil {
+		l.Warn("Failed to close redis", zap.Error(err))
 	}
-}
 
-func (l *labbot) shutdown() error {
-	<-l.waitSignal
-	l.Stop() // stop cron job
-	return l.Shutdown(context.Background())
+	l.Info(
+		"shutdown completed",
+		zap.Duration("elapsed", time.Since(start)),
+		zap.Bool("drained", completed),
+		zap.Bool("server_closed", serverErr == nil),
+	)
+	l.Sync()
+	return serverErr
 }
@@ -0,0 +1,179 @@
+package labbot
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// lastOutKey is the hash of id and lastOut which is waiting for acknowledgment
+const lastOutKey = key + ":lastout"
+
+// actionLastOut is the choice to acknowledge the checklist, see chat.go
+const actionLastOut = "戸締まり確認"
+
+// lastOut is the checklist reminder to the last person who left the lab
+type lastOut struct {
+	ID   string    `json:"id"`
+	Name string    `json:"name"`
+	At   time.Time `json:"at"`
+	// Deadline is when it is escalated, it's kept in redis to survive restarts
+	Deadline time.Time `json:"deadline"`
+}
+
+// checklist returns --checklist without empty items, `--checklist ""` disables the reminder.
+func (l *labbot) checklist() []string {
+	items := make([]string, 0, len(l.Checklist))
+	for _, item := range l.Checklist {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// remindLastOut sends the checklist to the person who left the lab last on LINE and chat.
+// It is escalated to --last-out-channel by sweepLastOut if nobody acknowledges it within --last-out-timeout.
+func (l *labbot) remindLastOut(name string, at time.Time) {
+	items := l.checklist()
+	if len(items) == 0 {
+		return
+	}
+	reminder := &lastOut{
+		ID:       newRandomID(), // subscription.go
+		Name:     name,
+		At:       at,
+		Deadline: time.Now().Add(l.LastOutTimeout),
+	}
+	serialized, err := json.Marshal(reminder)
+	if err != nil {
+		l.Error("JSON Marshal error", zap.Error(err))
+		return
+	}
+	if err := l.Redis.HSet(lastOutKey, reminder.ID, string(serialized)).Err(); err != nil {
+		l.Error("Could not set the last out reminder to redis", zap.Error(err))
+		return
+	}
+
+	member, err := l.findMember(name) // members.go
+	if err != nil {
+		l.Warn("Failed to find member", zap.String("name", name), zap.Error(err))
+	}
+	locale := l.memberLocale(member) // locale.go
+	data := &messageData{Name: name, Names: strings.Join(items, listSeparator(locale))}
+	text := l.messageIn(locale, "lastout.checklist", data)
+	label := l.messageIn(locale, "choice.lastout", data)
+
+	if member != nil && member.Active {
+		if err := l.pushLastOut(member.UserID, reminder.ID, l.messageIn(locale, "lastout.title", data), text, label); err != nil {
+			l.Warn("Failed to send the checklist to LINE", zap.String("name", name), zap.Error(err))
+		}
+	}
+	userID, err := l.chatUserOf(name)
+	if err != nil {
+		l.Warn("Failed to find the chat user", zap.String("name", name), zap.Error(err))
+		return
+	}
+	l.sendDirectMessage(userID, &ChatMessage{
+		Attachment: &ChatAttachment{
+			Text:       text,
+			Color:      "#c0392b",
+			CallbackID: "lastout",
+			Choices: []Choice{
+				{Name: actionLastOut, Text: label, Style: "primary", Value: reminder.ID},
+			},
+		},
+	})
+}
+
+// pushLastOut sends the checklist with the button whose postback is "action=lastout&id=...".
+func (l *labbot) pushLastOut(to, id, title, text, label string) error {
+	template := linebot.NewButtonsTemplate(
+		"", title, text,
+		linebot.NewPostbackTemplateAction(label, "action=lastout&id="+id, ""),
+	)
+	if _, err := l.LINE.PushMessage(to, linebot.NewTemplateMessage(text, template)).Do(); err != nil {
+		return errors.Wrap(err, "Failed to push message")
+	}
+	return nil
+}
+
+// chatUserOf returns the chat user id of the member, who is linked by "iam" or has the same name.
+func (l *labbot) chatUserOf(name string) (string, error) {
+	linked, err := l.Redis.HGetAll(slackMembersKey).Result() // checkin.go
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to get linked members")
+	}
+	for userID, linkedName := range linked {
+		if linkedName == name {
+			return userID, nil
+		}
+	}
+	return l.Chat.FindUserID(name)
+}
+
+// ackLastOut acknowledges the checklist, and returns the reply.
+func (l *labbot) ackLastOut(id, locale string) string {
+	// Removing is atomic, so that it is not escalated after acknowledged
+	n, err := l.Redis.HDel(lastOutKey, id).Result()
+	if err != nil {
+		l.Error("Could not acknowledge the last out reminder", zap.Error(err))
+		return l.messageIn(locale, "notify.failed", &messageData{})
+	}
+	if n == 0 {
+		return l.messageIn(locale, "lastout.expired", &messageData{})
+	}
+	l.Info("the last out reminder is acknowledged", zap.String("id", id))
+	return l.messageIn(locale, "lastout.acked", &messageData{})
+}
+
+// sweepLastOut escalates reminders which are past the deadline. It runs every minute
+// on the leader as the cron job, so reminders are escalated even after restarts.
+func (l *labbot) sweepLastOut() error {
+	reminders, err := l.Redis.HGetAll(lastOutKey).Result()
+	if err != nil {
+		return errors.Wrap(err, "Could not get the last out reminders")
+	}
+	now := time.Now()
+	for id, serialized := range reminders {
+		reminder := new(lastOut)
+		if err := json.Unmarshal([]byte(serialized), reminder); err != nil {
+			l.Warn("Could not unmarshal the last out reminder", zap.String("id", id), zap.Error(err))
+			continue
+		}
+		// Reminders stored before Deadline was added
+		deadline := reminder.Deadline
+		if deadline.IsZero() {
+			deadline = reminder.At.Add(l.LastOutTimeout)
+		}
+		if now.Before(deadline) {
+			continue
+		}
+		l.escalateLastOut(reminder)
+	}
+	return nil
+}
+
+// escalateLastOut posts to --last-out-channel if the reminder is not acknowledged.
+func (l *labbot) escalateLastOut(reminder *lastOut) {
+	n, err := l.Redis.HDel(lastOutKey, reminder.ID).Result()
+	if err != nil {
+		l.Error("Could not get the last out reminder", zap.Error(err))
+		return
+	}
+	if n == 0 || l.LastOutChannel == "" {
+		return
+	}
+	msg := l.message("lastout.escalated", &messageData{
+		Name:  reminder.Name,
+		Time:  formatTime(l.Locale, reminder.At),
+		Names: strings.Join(l.checklist(), listSeparator(l.Locale)),
+	})
+	if err := l.postToChat(l.LastOutChannel, msg); err != nil { // chat.go
+		l.Error("Failed to escalate the last out reminder", zap.Error(err))
+	}
+}
@@ -0,0 +1,69 @@
+package labbot
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/labbot/internal/testserver"
+)
+
+func TestSweepLastOut(t *testing.T) {
+	slack := testserver.NewSlack()
+	defer slack.Close()
+	line := testserver.NewLINE()
+	defer line.Close()
+	l, _ := newTestLabbot(t, slack, line)
+	l.LastOutChannel = "general"
+	l.LastOutTimeout = 10 * time.Minute
+
+	now := time.Now()
+	reminders := []*lastOut{
+		{ID: "due", Name: "ありす", At: now.Add(-15 * time.Minute), Deadline: now.Add(-5 * time.Minute)},
+		{ID: "waiting", Name: "ぼぶ", At: now.Add(-5 * time.Minute), Deadline: now.Add(5 * time.Minute)},
+		// stored before Deadline was added
+		{ID: "legacy", Name: "きゃろる", At: now.Add(-time.Hour)},
+	}
+	for _, reminder := range reminders {
+		serialized, _ := json.Marshal(reminder)
+		if err := l.Redis.HSet(lastOutKey, reminder.ID, string(serialized)).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := l.sweepLastOut(); err != nil {
+		t.Fatalf("sweepLastOut() = %v", err)
+	}
+	left, err := l.Redis.HKeys(lastOutKey).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 1 || left[0] != "waiting" {
+		t.Errorf("reminders after sweep = %v, want [waiting]", left)
+	}
+
+	escalated := make(map[string]bool)
+	for _, msg := range slack.Messages() {
+		if msg.Channel != "CGENERAL" {
+			continue
+		}
+		for _, name := range []string{"ありす", "ぼぶ", "きゃろる"} {
+			if strings.Contains(msg.Text, name) {
+				escalated[name] = true
+			}
+		}
+	}
+	if !escalated["ありす"] || !escalated["きゃろる"] || escalated["ぼぶ"] {
+		t.Errorf("escalated = %v, want ありす and きゃろる", escalated)
+	}
+
+	// Escalated reminders are removed, so they are escalated only once
+	slack.Reset()
+	if err := l.sweepLastOut(); err != nil {
+		t.Fatalf("sweepLastOut() = %v", err)
+	}
+	if n := len(slack.CallsTo("/api/chat.postMessage")); n != 0 {
+		t.Errorf("posts of the second sweep = %d, want 0", n)
+	}
+}
@@ -0,0 +1,235 @@
+package labbot
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// leaderKey is the lock which is held by the leader instance
+const leaderKey = key + ":leader"
+
+// leaseLock is a lock with expiration, which is held by one owner at a time.
+type leaseLock interface {
+	// Acquire takes the lock for ttl if nobody holds it, or extends it if owner holds it.
+	Acquire(owner string, ttl time.Duration) (bool, error)
+	// Release gives up the lock if owner holds it.
+	Release(owner string) error
+}
+
+// acquireScript sets the owner if the lock is free, or extends the lease of the owner.
+var acquireScript = redis.NewScript(`
+local current = redis.call("GET", KEYS[1])
+if current == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+if current == false then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// releaseScript deletes the lock only if the owner holds it.
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// redisLock is leaseLock which is shared by instances through redis
+type redisLock struct {
+	client *redis.Client
+	key    string
+}
+
+func (r *redisLock) Acquire(owner string, ttl time.Duration) (bool, error) {
+	n, err := acquireScript.Run(r.client, []string{r.key}, owner, int64(ttl/time.Millisecond)).Int()
+	if err != nil {
+		return false, errors.Wrap(err, "Could not acquire the leader lock")
+	}
+	return n == 1, nil
+}
+
+func (r *redisLock) Release(owner string) error {
+	if err := releaseScript.Run(r.client, []string{r.key}, owner).Err(); err != nil {
+		return errors.Wrap(err, "Could not release the leader lock")
+	}
+	return nil
+}
+
+// memoryLock is leaseLock in a process, e.g. for instances in tests.
+type memoryLock struct {
+	mu      sync.Mutex
+	owner   string
+	expires time.Time
+	now     func() time.Time
+}
+
+func newMemoryLock() *memoryLock {
+	return &memoryLock{now: time.Now}
+}
+
+func (m *memoryLock) Acquire(owner string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	if m.owner != "" && m.owner != owner && now.Before(m.expires) {
+		return false, nil
+	}
+	m.owner = owner
+	m.expires = now.Add(ttl)
+	return true, nil
+}
+
+func (m *memoryLock) Release(owner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.owner == owner {
+		m.owner = ""
+	}
+	return nil
+}
+
+// elector campaigns for the leader by renewing the lease every ttl/3.
+// It calls elected when it becomes the leader, and demoted when it loses the lease.
+type elector struct {
+	lock leaseLock
+	id   string
+	ttl  time.Duration
+	*zap.Logger
+
+	elected func()
+	demoted func()
+}
+
+func newInstanceID() string {
+	host, _ := os.Hostname()
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(buf))
+}
+
+// run campaigns until stop is closed, and releases the lock when it stops.
+// If it is the leader, demoted is called before it returns.
+func (e *elector) run(stop <-chan struct{}) {
+	interval := e.ttl / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	leader := false
+	var renewed time.Time
+	for {
+		now := time.Now()
+		ok, err := e.lock.Acquire(e.id, e.ttl)
+		switch {
+		case err != nil:
+			e.Warn("Failed to campaign for the leader", zap.Error(err))
+			// The lease may be taken by others after it expires, so the leader
+			// steps down at the last tick before it, not to lead with others.
+			if leader && now.Sub(renewed) >= e.ttl-interval {
+				leader = false
+				e.Warn("lost the leader lease", zap.String("id", e.id))
+				e.demoted()
+			}
+		case ok:
+			renewed = now
+			if !leader {
+				leader = true
+				e.Info("elected as the leader", zap.String("id", e.id))
+				e.elected()
+			}
+		case leader:
+			leader = false
+			e.Warn("the leader lease is taken", zap.String("id", e.id))
+			e.demoted()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			if leader {
+				e.demoted()
+				if err := e.lock.Release(e.id); err != nil {
+					e.Warn("Failed to release the leader lock", zap.Error(err))
+				}
+			}
+			return
+		}
+	}
+}
+
+// isLeader reports whether this instance runs cron jobs and handles mentions.
+// It is always true without --leader-lease.
+func (l *labbot) isLeader() bool {
+	return atomic.LoadInt32(&l.leader) == 1
+}
+
+// lead starts the work which only the leader does.
+func (l *labbot) lead() {
+	atomic.StoreInt32(&l.leader, 1)
+	l.Start() // start cron job
+	atomic.StoreInt32(&l.cronRunning, 1)
+	go l.catchUpJobs(time.Now()) // catchup.go
+	if l.RichMenu != "" {
+		// Only one instance replaces the menu, not to delete the menus of others
+		l.richMenuOnce.Do(func() {
+			go func() {
+				if err := l.setupRichMenu(); err != nil { // richmenu.go
+					l.Warn("Failed to setup rich menu", zap.Error(err))
+				}
+			}()
+		})
+	}
+}
+
+// unlead stops the work which only the leader does.
+func (l *labbot) unlead() {
+	atomic.StoreInt32(&l.leader, 0)
+	l.Stop() // stop cron job
+	atomic.StoreInt32(&l.cronRunning, 0)
+}
+
+// campaign runs leader election with --leader-lease, or leads without election.
+// It returns after stop is closed and cron jobs are stopped. Cron is started and
+// stopped only here, because robfig/cron is not safe to do it concurrently.
+func (l *labbot) campaign(stop <-chan struct{}) {
+	defer close(l.campaignDone)
+	if l.LeaderLease <= 0 {
+		l.lead()
+		<-stop
+		l.unlead()
+		return
+	}
+	e := &elector{
+		lock:    &redisLock{client: l.Redis, key: leaderKey},
+		id:      newInstanceID(),
+		ttl:     l.LeaderLease,
+		Logger:  l.Logger,
+		elected: l.lead,
+		demoted: l.unlead,
+	}
+	e.run(stop)
+}
+
+// leaderHandler passes mentions from the connection like slack RTM only on the leader,
+// because all instances receive the same mentions.
+type leaderHandler struct {
+	*labbot
+}
+
+func (h *leaderHandler) OnMention(m *Mention) {
+	if !h.isLeader() {
+		return
+	}
+	h.labbot.OnMention(m)
+}
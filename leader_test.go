@@ -0,0 +1,216 @@
+package labbot
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const testLease = 60 * time.Millisecond
+
+// flakyLock is leaseLock which fails while fail is 1
+type flakyLock struct {
+	leaseLock
+	fail int32
+}
+
+func (f *flakyLock) Acquire(owner string, ttl time.Duration) (bool, error) {
+	if atomic.LoadInt32(&f.fail) == 1 {
+		return false, errors.New("connection refused")
+	}
+	return f.leaseLock.Acquire(owner, ttl)
+}
+
+// testElector records elections of the elector
+type testElector struct {
+	*elector
+	lock    *flakyLock
+	events  chan string
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func startElector(id string, lock leaseLock) *testElector {
+	te := &testElector{
+		lock:    &flakyLock{leaseLock: lock},
+		events:  make(chan string, 10),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	te.elector = &elector{
+		lock:    te.lock,
+		id:      id,
+		ttl:     testLease,
+		Logger:  zap.NewNop(),
+		elected: func() { te.events <- "elected" },
+		demoted: func() { te.events <- "demoted" },
+	}
+	go func() {
+		te.run(te.stop)
+		close(te.stopped)
+	}()
+	return te
+}
+
+func (te *testElector) shutdown() {
+	close(te.stop)
+	<-te.stopped
+}
+
+func (te *testElector) expect(t *testing.T, want string) {
+	t.Helper()
+	select {
+	case got := <-te.events:
+		if got != want {
+			t.Fatalf("%s is %s, want %s", te.id, got, want)
+		}
+	case <-time.After(10 * testLease):
+		t.Fatalf("%s is not %s", te.id, want)
+	}
+}
+
+func (te *testElector) expectNothing(t *testing.T) {
+	t.Helper()
+	select {
+	case got := <-te.events:
+		t.Fatalf("%s is %s unexpectedly", te.id, got)
+	case <-time.After(2 * testLease):
+	}
+}
+
+func TestElectorTakeOverOnStop(t *testing.T) {
+	lock := newMemoryLock()
+	a := startElector("a", lock)
+	a.expect(t, "elected")
+	b := startElector("b", lock)
+	defer b.shutdown()
+
+	// Only one leads while the leader renews the lease
+	b.expectNothing(t)
+
+	// The leader releases the lock when it stops
+	a.shutdown()
+	a.expect(t, "demoted")
+	b.expect(t, "elected")
+}
+
+func TestElectorTakeOverOnExpire(t *testing.T) {
+	lock := newMemoryLock()
+	a := startElector("a", lock)
+	defer a.shutdown()
+	a.expect(t, "elected")
+	b := startElector("b", lock)
+	defer b.shutdown()
+	b.expectNothing(t)
+
+	// The leader cannot renew the lease, e.g. redis is down for it.
+	// It's demoted after the lease expires, and the other takes over.
+	atomic.StoreInt32(&a.lock.fail, 1)
+	a.expect(t, "demoted")
+	b.expect(t, "elected")
+
+	// The old leader cannot take it back after it recovers
+	atomic.StoreInt32(&a.lock.fail, 0)
+	a.expectNothing(t)
+}
+
+func TestElectorStepsDownBeforeLeaseExpires(t *testing.T) {
+	lock := newMemoryLock()
+	flaky := &flakyLock{leaseLock: lock}
+	elected := make(chan struct{}, 1)
+	// remaining is the lease left when the leader is demoted
+	remaining := make(chan time.Duration, 1)
+	e := &elector{
+		lock:    flaky,
+		id:      "a",
+		ttl:     testLease,
+		Logger:  zap.NewNop(),
+		elected: func() { elected <- struct{}{} },
+		demoted: func() {
+			lock.mu.Lock()
+			remaining <- lock.expires.Sub(lock.now())
+			lock.mu.Unlock()
+		},
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		e.run(stop)
+		close(stopped)
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	select {
+	case <-elected:
+	case <-time.After(10 * testLease):
+		t.Fatal("a is not elected")
+	}
+	atomic.StoreInt32(&flaky.fail, 1)
+	select {
+	case left := <-remaining:
+		// Others can take the lease when it expires, so the leader must be gone before it
+		if left <= 0 {
+			t.Errorf("a is demoted %v after the lease expired", -left)
+		}
+	case <-time.After(10 * testLease):
+		t.Fatal("a is not demoted")
+	}
+}
+
+func TestElectorKeepsLeaderOnShortError(t *testing.T) {
+	lock := newMemoryLock()
+	a := startElector("a", lock)
+	defer a.shutdown()
+	a.expect(t, "elected")
+
+	// A failure shorter than the lease doesn't demote the leader
+	atomic.StoreInt32(&a.lock.fail, 1)
+	time.Sleep(testLease / 2)
+	atomic.StoreInt32(&a.lock.fail, 0)
+	a.expectNothing(t)
+}
+
+func TestMemoryLock(t *testing.T) {
+	now := time.Date(2017, 10, 18, 9, 0, 0, 0, time.UTC)
+	lock := newMemoryLock()
+	lock.now = func() time.Time { return now }
+
+	tests := []struct {
+		op    string
+		owner string
+		after time.Duration
+		want  bool
+	}{
+		{"acquire", "a", 0, true},
+		{"acquire", "b", 0, false},
+		{"acquire", "a", 50 * time.Second, true}, // extends until 9:01:50
+		{"acquire", "b", 50 * time.Second, false},
+		{"acquire", "b", 10 * time.Second, true}, // expired
+		{"release", "a", 0, false},               // not the owner
+		{"acquire", "a", 0, false},
+		{"release", "b", 0, false},
+		{"acquire", "a", 0, true},
+	}
+	for i, tt := range tests {
+		now = now.Add(tt.after)
+		if tt.op == "release" {
+			if err := lock.Release(tt.owner); err != nil {
+				t.Fatalf("#%d: Release(%s) = %v", i, tt.owner, err)
+			}
+			continue
+		}
+		got, err := lock.Acquire(tt.owner, time.Minute)
+		if err != nil {
+			t.Fatalf("#%d: Acquire(%s) = %v", i, tt.owner, err)
+		}
+		if got != tt.want {
+			t.Errorf("#%d: Acquire(%s) = %v, want %v", i, tt.owner, got, tt.want)
+		}
+	}
+}
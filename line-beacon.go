@@ -8,8 +8,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/go-redis/redis"
 	"github.com/line/line-bot-sdk-go/linebot"
-	"github.com/nlopes/slack"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
@@ -49,6 +50,7 @@ func (t *jsonTime) UnmarshalJSON(formatted []byte) error {
 type Person struct {
 	Name       string   `json:"name"`
 	Inlab      bool     `json:"in_lab"`
+	Room       string   `json:"room,omitempty"`
 	UpdateTime jsonTime `json:"updated_at"`
 }
 
@@ -75,79 +77,98 @@ func (l *labbot) lineAPIInit() func([]*linebot.Event, *http.Request) {
 		l.expire()
 
 	}
-	return l.fromBeacon
+	l.migrateFollowers() // members.go
+	return l.fromLINE    // line.go
 }
 
+// expire removes people who haven't updated for 24 hours.
+// It's called from handlers of chat, kiosk and cron as well as webhook, so timeStamp is locked.
 func (l *labbot) expire() {
+	mu.Lock()
+	defer mu.Unlock()
 	for k, v := range timeStamp {
 		duration := time.Since(time.Time(v.UpdateTime))
 		l.Info("diff", zap.String("who", k), zap.Float64("since", duration.Hours()))
 		if duration.Hours() > 24 {
 			l.Info("delete", zap.String("who", k))
-			mu.Lock()
 			delete(timeStamp, k)
-			mu.Unlock()
 		}
 	}
 }
 
 func (l *labbot) fromBeacon(events []*linebot.Event, r *http.Request) {
 	// Find the slack channel
-	channelID, err := l.findChannelID("timestamp")
+	channelID, err := l.Chat.FindChannelID("timestamp")
 	if err != nil {
+		// Presence should be recorded even if slack is not available
 		l.Warn("Failed to find channel id", zap.Error(err))
-		return
 	}
 
 	for _, event := range events {
-		if event.Type == linebot.EventTypeBeacon {
-			src := event.Source
-			userID := src.UserID
-			bot, err := linebot.New(channelSecret, channelToken)
-			if err != nil {
-				l.Error("Failed to construct linebot", zap.Error(err))
-				return
-			}
-			res, err := bot.GetProfile(userID).Do()
-			if err != nil {
-				l.Error("Failed to get user profile", zap.Error(err))
-				return
-			}
+		if event.Type != linebot.EventTypeBeacon {
+			continue
+		}
+		// One failure should not drop the rest of events
+		if err := l.handleBeacon(event, channelID); err != nil {
+			beaconFailures.Inc() // metrics.go
+			l.Error("Failed to handle beacon event", zap.Error(err))
+		}
+	}
+	l.storePeopleData()
+}
+
+func (l *labbot) handleBeacon(event *linebot.Event, channelID string) error {
+	res, err := l.member(event.Source.UserID) // members.go
+	if err != nil {
+		return errors.Wrap(err, "Failed to get member")
+	}
 
-			switch event.Beacon.Type {
-			case linebot.BeaconEventTypeEnter:
-				// When already in the laboratory
-				if isAlready(res.DisplayName) {
-					return
-				}
-				_, err := bot.ReplyMessage(
-					event.ReplyToken,
-					linebot.NewTextMessage(fmt.Sprintf("%sさん%s♡", res.DisplayName, greeting())),
-				).Do()
-				if err != nil {
-					l.Error("Failed to reply message", zap.Error(err))
-					return
-				}
-				l.welcomeToLab(res.DisplayName, channelID)
-			case linebot.BeaconEventTypeLeave:
-				_, err := bot.ReplyMessage(
-					event.ReplyToken,
-					linebot.NewTextMessage(fmt.Sprintf("%sさん、%s", res.DisplayName, getMessageWorkingTime(res.DisplayName))),
-				).Do()
-				if err != nil {
-					l.Error("Failed to reply message", zap.Error(err))
-					return
-				}
-				l.seeyouFromLab(res.DisplayName, channelID)
+	// Use the time of event, so that simulated events can be recorded at a fake time
+	now := event.Timestamp
+	if now.IsZero() {
+		now = time.Now()
+	}
+	beaconEvents.WithLabelValues(string(event.Beacon.Type)).Inc() // metrics.go
+	room := l.roomOf(event.Beacon.Hwid)
+	switch event.Beacon.Type {
+	case linebot.BeaconEventTypeEnter:
+		// When already in the laboratory
+		if isAlready(res.DisplayName) {
+			if from := l.roomOfPerson(res.DisplayName); from != room {
+				l.moveRoom(res.DisplayName, from, room, channelID, now, sourceBeacon)
 			}
+			return nil
+		}
+		_, err := l.LINE.ReplyMessage(
+			event.ReplyToken,
+			linebot.NewTextMessage(l.greeting(l.memberLocale(res), res.DisplayName, now)),
+		).Do()
+		if err != nil {
+			l.Error("Failed to reply message", zap.Error(err))
 		}
+		l.welcomeToLab(res.DisplayName, room, channelID, now, sourceBeacon)
+	case linebot.BeaconEventTypeLeave:
+		// Not in the lab, or leaving the room which has been already moved from
+		if !isAlready(res.DisplayName) || l.roomOfPerson(res.DisplayName) != room {
+			return nil
+		}
+		_, err := l.LINE.ReplyMessage(
+			event.ReplyToken,
+			linebot.NewTextMessage(l.getMessageWorkingTime(l.memberLocale(res), res.DisplayName, now)),
+		).Do()
+		if err != nil {
+			l.Error("Failed to reply message", zap.Error(err))
+		}
+		l.seeyouFromLab(res.DisplayName, channelID, now, sourceBeacon)
 	}
-	l.storePeopleData()
+	return nil
 }
 
 func (l *labbot) storePeopleData() {
 	l.expire() // expire
+	mu.RLock()
 	serialized, err := json.Marshal(timeStamp)
+	mu.RUnlock()
 	if err != nil {
 		l.Error("JSON Marshal error", zap.Error(err))
 		return
@@ -159,56 +180,132 @@ func (l *labbot) storePeopleData() {
 	}
 }
 
-func (l *labbot) welcomeToLab(name, channelID string) {
-	now := time.Now()
-	setCameTimeStamp(name, now)
-	formatted := now.Format(tmformat)
+// presenceResetChannel is the pub/sub channel of presenceReset from "labbot presence reset"
+const presenceResetChannel = key + ":presence_reset"
 
-	msg := fmt.Sprintf("%sさんが%sに来ました♡", name, formatted)
-	params := parameter()
-	attachment := slack.Attachment{
-		Color: "#e67e22",
-		Text:  msg,
+// presenceReset is the presence which is removed by the CLI
+type presenceReset struct {
+	All   bool     `json:"all,omitempty"`
+	Names []string `json:"names,omitempty"`
+}
+
+// subscribePresenceReset starts to forget the presence which is reset by the CLI.
+// It returns after the subscription is confirmed, and stops when the returned PubSub is closed.
+func (l *labbot) subscribePresenceReset() (*redis.PubSub, error) {
+	pubsub := l.Redis.Subscribe(presenceResetChannel)
+	if _, err := pubsub.Receive(); err != nil {
+		pubsub.Close()
+		return nil, errors.Wrap(err, "Could not subscribe the presence reset")
 	}
-	params.Attachments = []slack.Attachment{attachment}
-	_, timestamp, err := l.PostMessage(channelID, "", params)
-	if err != nil {
-		l.Warn(`Failed to post "welcome message" to slack`, zap.Error(err))
-		return
+	go func() {
+		for msg := range pubsub.Channel() {
+			var reset presenceReset
+			if err := json.Unmarshal([]byte(msg.Payload), &reset); err != nil {
+				l.Error("Could not unmarshal json", zap.Error(err))
+				continue
+			}
+			l.forgetPresence(&reset)
+		}
+	}()
+	return pubsub, nil
+}
+
+func (l *labbot) forgetPresence(reset *presenceReset) {
+	mu.Lock()
+	if reset.All {
+		timeStamp = make(map[string]*Person)
+	}
+	for _, name := range reset.Names {
+		delete(timeStamp, name)
 	}
-	l.Info(
-		"Message successfully sent to slack",
-		zap.String("channelID", channelID),
-		zap.String("timestamp", timestamp),
-	)
+	mu.Unlock()
+	l.Info("presence is reset", zap.Bool("all", reset.All), zap.Strings("names", reset.Names))
+	// In case this instance has stored it again before the reset arrives
+	if l.isLeader() {
+		l.storePeopleData()
+	}
+}
+
+func (l *labbot) welcomeToLab(name, room, channelID string, now time.Time, src source) {
+	setCameTimeStamp(name, room, now)
+	l.appendHistory(Record{Name: name, Inlab: true, Room: room, Source: src, Time: now})
+	formatted := formatTime(l.Locale, now) // locale.go
+
+	msg := l.message("welcome", &messageData{Name: name, Room: room, Time: formatted})
+	l.post(channelID, &ChatMessage{
+		Attachment: &ChatAttachment{
+			Color:  "#e67e22",
+			Text:   msg,
+			Footer: l.sourceLabel(src), // history.go
+		},
+	})
+	l.notifyArrival(name, room, now) // subscription.go
 }
 
-func (l *labbot) seeyouFromLab(name, channelID string) {
-	now := time.Now()
+func (l *labbot) seeyouFromLab(name, channelID string, now time.Time, src source) {
+	room := l.roomOfPerson(name)
 	setLeaveTimeStamp(name, now)
-	formatted := now.Format(tmformat)
+	l.appendHistory(Record{Name: name, Inlab: false, Room: room, Source: src, Time: now})
+	formatted := formatTime(l.Locale, now) // locale.go
+
+	msg := l.message("seeyou", &messageData{Name: name, Room: room, Time: formatted})
+	l.post(channelID, &ChatMessage{
+		Attachment: &ChatAttachment{
+			Color:  "#3498db",
+			Text:   msg,
+			Footer: l.sourceLabel(src), // history.go
+		},
+	})
+	if countPeopleInLab() == 0 {
+		l.remindLastOut(name, now) // lastout.go
+	}
+}
 
-	msg := fmt.Sprintf("%sさんが%sに帰りました♡", name, formatted)
-	params := parameter()
-	attachment := slack.Attachment{
-		Color: "#3498db",
-		Text:  msg,
+// moveRoom records the transition between rooms without leaving the lab.
+func (l *labbot) moveRoom(name, from, to, channelID string, now time.Time, src source) {
+	setRoom(name, to)
+	l.appendHistory(Record{Name: name, Inlab: true, Room: to, From: from, Source: src, Time: now})
+	formatted := formatTime(l.Locale, now) // locale.go
+
+	msg := l.message("move", &messageData{Name: name, Room: to, From: from, Time: formatted})
+	l.post(channelID, &ChatMessage{
+		Attachment: &ChatAttachment{
+			Color:  "#f1c40f",
+			Text:   msg,
+			Footer: l.sourceLabel(src), // history.go
+		},
+	})
+}
+
+// roomOf returns the room name where the beacon is put.
+func (l *labbot) roomOf(hwid string) string {
+	if room, ok := l.Rooms[hwid]; ok {
+		return room
 	}
-	params.Attachments = []slack.Attachment{attachment}
-	_, timestamp, err := l.PostMessage(channelID, "", params)
-	if err != nil {
-		l.Warn(`Failed to post "seeyou message" to slack`, zap.Error(err))
-		return
+	return l.DefaultRoom
+}
+
+// roomOfPerson returns the room name where the person is in.
+func (l *labbot) roomOfPerson(name string) string {
+	mu.RLock()
+	defer mu.RUnlock()
+	if person, ok := timeStamp[name]; ok && person.Room != "" {
+		return person.Room
+	}
+	return l.DefaultRoom
+}
+
+func setRoom(name, room string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if person, ok := timeStamp[name]; ok {
+		person.Room = room
 	}
-	l.Info(
-		"Message successfully sent to slack",
-		zap.String("channelID", channelID),
-		zap.String("timestamp", timestamp),
-	)
 }
 
-func setCameTimeStamp(name string, now time.Time) {
+func setCameTimeStamp(name, room string, now time.Time) {
 	setTimeStamp(name, now, true)
+	setRoom(name, room)
 }
 
 func setLeaveTimeStamp(name string, now time.Time) {
@@ -216,6 +313,8 @@ func setLeaveTimeStamp(name string, now time.Time) {
 }
 
 func setTimeStamp(name string, now time.Time, inlab bool) {
+	mu.Lock()
+	defer mu.Unlock()
 	_, ok := timeStamp[name]
 	if !ok {
 		timeStamp[name] = &Person{
@@ -229,7 +328,20 @@ func setTimeStamp(name string, now time.Time, inlab bool) {
 	}
 }
 
+// lastUpdate returns the time when the presence of name is changed last,
+// that is the arrival while staying. It's zero for unknown people.
+func lastUpdate(name string) time.Time {
+	mu.RLock()
+	defer mu.RUnlock()
+	if person, ok := timeStamp[name]; ok {
+		return time.Time(person.UpdateTime)
+	}
+	return time.Time{}
+}
+
 func isAlready(name string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
 	coming, ok := timeStamp[name]
 	if ok {
 		return coming.Inlab
@@ -237,20 +349,21 @@ func isAlready(name string) bool {
 	return false
 }
 
-func greeting() string {
-	switch getTimeZone() {
+func (l *labbot) greeting(locale, name string, now time.Time) string {
+	data := &messageData{Name: name}
+	switch getTimeZone(now) {
 	case Morning:
-		return "おはようございます"
+		return l.messageIn(locale, "enter.morning", data)
 	case Daytime:
-		return "こんにちは"
+		return l.messageIn(locale, "enter.daytime", data)
 	case Night:
-		return "こんばんは"
+		return l.messageIn(locale, "enter.night", data)
 	}
-	return "遅くまでお疲れ様です"
+	return l.messageIn(locale, "enter.midnight", data)
 }
 
-func getTimeZone() timezone {
-	hour := time.Now().Hour()
+func getTimeZone(now time.Time) timezone {
+	hour := now.Hour()
 	if 11 <= hour && hour < 17 {
 		return Daytime
 	}
@@ -264,32 +377,59 @@ func getTimeZone() timezone {
 	return MidNight
 }
 
-func getMessageWorkingTime(name string) string {
+func (l *labbot) getMessageWorkingTime(locale, name string, now time.Time) string {
+	mu.RLock()
 	came := timeStamp[name]
 	t := time.Time(came.UpdateTime)
-	sub := int(time.Now().Sub(t).Hours())
+	mu.RUnlock()
+	sub := int(now.Sub(t).Hours())
+	data := &messageData{Name: name, Hours: sub}
 
 	// 0 ~ 3 hours
 	if 0 <= sub && sub < 4 {
-		return "お疲れ様です！"
+		return l.messageIn(locale, "leave.short", data)
 	}
 
 	// 4 ~ 8 hours
 	if 4 <= sub && sub <= 8 {
-		return "とっても頑張ったんですね…。尊敬します！"
+		return l.messageIn(locale, "leave.long", data)
 	}
 
-	return "死なないでくださいね！"
+	return l.messageIn(locale, "leave.overwork", data)
 }
 
-// "/whoisthere" handler
-func whoIsThere(w http.ResponseWriter, r *http.Request) {
+// countPeopleInLab returns the number of people in the lab.
+func countPeopleInLab() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	n := 0
+	for _, person := range timeStamp {
+		if person.Inlab {
+			n++
+		}
+	}
+	return n
+}
+
+// "/whoisthere" handler, "/whoisthere?room=実験室" returns people in the room.
+// People recorded before rooms were introduced have no room, they are in --default-room.
+func (l *labbot) whoIsThere(w http.ResponseWriter, r *http.Request) {
+	room := r.URL.Query().Get("room")
+	mu.RLock()
 	list := make([]*Person, 0, len(timeStamp))
 	for _, who := range timeStamp {
-		if who.Inlab {
+		if !who.Inlab {
+			continue
+		}
+		whoRoom := who.Room
+		if whoRoom == "" {
+			whoRoom = l.DefaultRoom
+		}
+		if room == "" || whoRoom == room {
 			list = append(list, who)
 		}
 	}
+	mu.RUnlock()
 	sort.Slice(list, func(i, j int) bool {
 		return list[i].Name < list[j].Name
 	})
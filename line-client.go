@@ -0,0 +1,152 @@
+package labbot
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+	"github.com/pkg/errors"
+)
+
+// retryKeyHeader makes push and multicast idempotent, LINE accepts the same key only once
+// and responds 409 to the retried request which has been accepted.
+const retryKeyHeader = "X-Line-Retry-Key"
+
+// retryTransport retries the request to Messaging API with exponential backoff,
+// when the API responds 429 or 5xx, or the connection is timed out.
+// POST requests may have been processed when they are timed out or failed with 5xx,
+// so they are retried only if they have X-Line-Retry-Key, or they are not processed
+// certainly, that is 429 or refused connection.
+type retryTransport struct {
+	base    http.RoundTripper
+	retry   int
+	backoff time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	idempotent := req.Method != http.MethodPost
+	if !idempotent && acceptsRetryKey(req.URL.Path) {
+		// RoundTrip must not modify the request of the caller
+		req = req.Clone(req.Context())
+		req.Header.Set(retryKeyHeader, newRetryKey())
+		idempotent = true
+	}
+	wait := t.backoff
+	attempt := req
+	for i := 0; ; i++ {
+		res, err := t.base.RoundTrip(attempt)
+		if i > 0 && err == nil && res.StatusCode == http.StatusConflict && res.Header.Get("X-Line-Accepted-Request-Id") != "" {
+			// The previous attempt has reached LINE in fact
+			res.Body.Close()
+			res.StatusCode = http.StatusOK
+			res.Status = "200 OK"
+			res.Body = ioutil.NopCloser(strings.NewReader("{}"))
+		}
+		if !t.shouldRetry(res, err, idempotent) || i >= t.retry || (req.Body != nil && req.GetBody == nil) {
+			outcome := "success"
+			if err != nil || res.StatusCode >= 400 {
+				outcome = "failure"
+			}
+			lineRequests.WithLabelValues(outcome).Inc() // metrics.go
+			return res, err
+		}
+		if res != nil {
+			if after := retryAfter(res); after > 0 {
+				wait = after
+			}
+			res.Body.Close()
+		}
+		lineRetries.Inc()
+
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		wait *= 2
+
+		// Each attempt is a new request, the body of the last attempt has been consumed
+		attempt = req.Clone(req.Context())
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, errors.Wrap(err, "Failed to rewind request body")
+			}
+			attempt.Body = body
+		}
+	}
+}
+
+func (t *retryTransport) shouldRetry(res *http.Response, err error, idempotent bool) bool {
+	if err != nil {
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return true
+		}
+		nerr, ok := err.(net.Error)
+		return idempotent && ok && nerr.Timeout()
+	}
+	if res.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return idempotent && res.StatusCode >= 500
+}
+
+// acceptsRetryKey reports whether the API accepts X-Line-Retry-Key.
+// Reply is not, but its reply token can be used only once anyway.
+func acceptsRetryKey(path string) bool {
+	for _, api := range []string{"/message/push", "/message/multicast", "/message/narrowcast", "/message/broadcast"} {
+		if strings.HasSuffix(path, api) {
+			return true
+		}
+	}
+	return false
+}
+
+// newRetryKey returns UUID v4 which is the format of X-Line-Retry-Key.
+func newRetryKey() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	buf[6] = buf[6]&0x0f | 0x40
+	buf[8] = buf[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", buf[0:4], buf[4:6], buf[6:8], buf[8:10], buf[10:])
+}
+
+func retryAfter(res *http.Response) time.Duration {
+	sec, err := strconv.Atoi(res.Header.Get("Retry-After"))
+	if err != nil {
+		return 0
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// newLINEClient constructs the client which is shared by all LINE API calls.
+func (l *labbot) newLINEClient() (*linebot.Client, error) {
+	base := http.DefaultTransport
+	if l.DryRun {
+		base = &dryRunTransport{base: base, Logger: l.Logger} // dryrun.go
+	}
+	client := &http.Client{
+		Timeout: l.LineTimeout,
+		Transport: &retryTransport{
+			base:    base,
+			retry:   l.LineRetry,
+			backoff: 500 * time.Millisecond,
+		},
+	}
+	opts := []linebot.ClientOption{linebot.WithHTTPClient(client)}
+	if l.LineAPI != "" {
+		opts = append(opts, linebot.WithEndpointBase(l.LineAPI))
+	}
+	bot, err := linebot.New(channelSecret, channelToken, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to construct linebot")
+	}
+	return bot, nil
+}
@@ -0,0 +1,98 @@
+package labbot
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		statuses []int
+		want     int // status code returned to the caller
+		calls    int
+	}{
+		{"reply is not retried on 5xx", "/v2/bot/message/reply", []int{500, 200}, 500, 1},
+		{"reply is retried on 429", "/v2/bot/message/reply", []int{429, 200}, 200, 2},
+		{"push is retried on 5xx", "/v2/bot/message/push", []int{500, 502, 200}, 200, 3},
+		{"accepted push is not sent twice", "/v2/bot/message/multicast", []int{500, 409}, 200, 2},
+		{"retry is limited", "/v2/bot/message/push", []int{500, 500, 500, 500, 500}, 500, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var keys []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				keys = append(keys, r.Header.Get(retryKeyHeader))
+				status := tt.statuses[len(keys)-1]
+				if status == http.StatusConflict {
+					w.Header().Set("X-Line-Accepted-Request-Id", "accepted")
+				}
+				w.WriteHeader(status)
+			}))
+			defer srv.Close()
+
+			client := &http.Client{Transport: &retryTransport{
+				base:    http.DefaultTransport,
+				retry:   3,
+				backoff: time.Millisecond,
+			}}
+			res, err := client.Post(srv.URL+tt.path, "application/json", strings.NewReader(`{"to":"U1"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", res.StatusCode, tt.want)
+			}
+			if len(keys) != tt.calls {
+				t.Errorf("calls = %d, want %d", len(keys), tt.calls)
+			}
+			if acceptsRetryKey(tt.path) {
+				for _, key := range keys {
+					if key == "" || key != keys[0] {
+						t.Errorf("retry keys = %v, want the same key", keys)
+						break
+					}
+				}
+			} else if keys[0] != "" {
+				t.Errorf("retry key = %q, want none", keys[0])
+			}
+		})
+	}
+}
+
+func TestRetryTransportRewindsBody(t *testing.T) {
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer srv.Close()
+
+	// Reply is retried without X-Line-Retry-Key
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/v2/bot/message/reply", strings.NewReader(`{"replyToken":"T"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := req.Body
+	transport := &retryTransport{base: http.DefaultTransport, retry: 3, backoff: time.Millisecond}
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if len(bodies) != 2 || bodies[0] != `{"replyToken":"T"}` || bodies[1] != bodies[0] {
+		t.Errorf("bodies = %q, want the same body twice", bodies)
+	}
+	if req.Body != body {
+		t.Error("RoundTrip modified the request of the caller")
+	}
+}
@@ -0,0 +1,236 @@
+package labbot
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// followersKey is used before the member registry, see migrateFollowers
+	followersKey = key + ":line:followers"
+	optOutKey    = key + ":line:optout"
+
+	// maximum number of recipients of multicast
+	maxMulticast = 150
+)
+
+// fromLINE dispatches the events of LINE webhook
+func (l *labbot) fromLINE(events []*linebot.Event, r *http.Request) {
+	l.work.Add(1) // wait on shutdown
+	defer l.work.Done()
+
+	beacons := make([]*linebot.Event, 0, len(events))
+	for _, event := range events {
+		lineEvents.WithLabelValues(string(event.Type)).Inc() // metrics.go
+		switch event.Type {
+		case linebot.EventTypeBeacon:
+			beacons = append(beacons, event)
+		case linebot.EventTypeMessage:
+			l.replyToMessage(event)
+		case linebot.EventTypeFollow:
+			l.follow(event.Source.UserID, event.Timestamp) // members.go
+		case linebot.EventTypeUnfollow:
+			l.unfollow(event.Source.UserID)
+		case linebot.EventTypeJoin:
+			l.greetGroup(event)
+		case linebot.EventTypePostback:
+			l.replyToPostback(event) // richmenu.go
+		}
+	}
+	if len(beacons) > 0 {
+		l.fromBeacon(beacons, r) // line-beacon.go
+	}
+}
+
+// replyToMessage answers the text message with the same commands as slack.
+func (l *labbot) replyToMessage(event *linebot.Event) {
+	message, ok := event.Message.(*linebot.TextMessage)
+	if !ok {
+		return
+	}
+	req := l.lineRequest(message.Text, event.Source.UserID)
+	reply, ok := l.answerTimeQuery(req) // timequery.go
+	if !ok {
+		reply, ok = l.answer(lineCommands, req)
+	}
+	if !ok {
+		reply, ok = l.answer(commands, req)
+	}
+	if !ok {
+		// Stay quiet in groups, the message may be for other people
+		if event.Source.Type != linebot.EventSourceTypeUser {
+			return
+		}
+		reply = l.helpMessage(l.localeOfRequest(req)) // locale.go
+	}
+	_, err := l.LINE.ReplyMessage(event.ReplyToken, linebot.NewTextMessage(reply)).Do()
+	if err != nil {
+		l.Error("Failed to reply message", zap.Error(err))
+	}
+}
+
+func (l *labbot) lineRequest(text, userID string) *commandRequest {
+	return &commandRequest{
+		Text:   text,
+		UserID: userID,
+		member: func() (string, error) {
+			member, err := l.member(userID)
+			if err != nil {
+				return "", err
+			}
+			return member.DisplayName, nil
+		},
+	}
+}
+
+func (l *labbot) helpMessage(locale string) string {
+	keywords := make([]string, 0, len(commands)+len(lineCommands))
+	for _, cmd := range append(commands, lineCommands...) {
+		keywords = append(keywords, l.messageIn(locale, cmd.usage, &messageData{}))
+	}
+	return l.messageIn(locale, "help", &messageData{Names: strings.Join(keywords, listSeparator(locale))})
+}
+
+// greetGroup replies to the group which the bot joined.
+// Members are registered only when they add the bot as a friend.
+func (l *labbot) greetGroup(event *linebot.Event) {
+	_, err := l.LINE.ReplyMessage(
+		event.ReplyToken,
+		linebot.NewTextMessage(l.message("greet.group", &messageData{})),
+	).Do()
+	if err != nil {
+		l.Error("Failed to reply message", zap.Error(err))
+	}
+}
+
+// commands only for LINE
+var lineCommands = []*command{
+	{
+		usage:    "usage.opt-out",
+		keywords: []string{"通知オフ", "通知off", "通知OFF", "notifications off", "Notifications off"},
+		run:      (*labbot).optOutLINE,
+	},
+	{
+		usage:    "usage.checkin",
+		keywords: []string{"チェックイン", "check in", "Check in"},
+		action:   "checkin",
+		run: func(l *labbot, req *commandRequest) string {
+			return l.checkinFromLINE(req, true)
+		},
+	},
+	{
+		usage:    "usage.checkout",
+		keywords: []string{"チェックアウト", "check out", "Check out"},
+		action:   "checkout",
+		run: func(l *labbot, req *commandRequest) string {
+			return l.checkinFromLINE(req, false)
+		},
+	},
+	{
+		usage:    "usage.opt-in",
+		keywords: []string{"通知オン", "通知on", "通知ON", "notifications on", "Notifications on"},
+		run:      (*labbot).optInLINE,
+	},
+	{
+		usage:    "usage.english",
+		keywords: []string{"English", "english"},
+		run: func(l *labbot, req *commandRequest) string {
+			return l.setLINELocale(req, localeEn) // locale.go
+		},
+	},
+	{
+		usage:    "usage.japanese",
+		keywords: []string{"日本語"},
+		run: func(l *labbot, req *commandRequest) string {
+			return l.setLINELocale(req, localeJa)
+		},
+	},
+}
+
+// チェックイン, チェックアウト
+func (l *labbot) checkinFromLINE(req *commandRequest, inlab bool) string {
+	name, err := req.member()
+	if err != nil {
+		l.Error("Could not find member name", zap.Error(err))
+		return l.message("member.unknown", &messageData{})
+	}
+	return l.recordPresence(name, inlab, time.Now(), sourceLINE)
+}
+
+// 通知オフ
+func (l *labbot) optOutLINE(req *commandRequest) string {
+	locale := l.localeOfRequest(req)
+	if err := l.Redis.SAdd(optOutKey, req.UserID).Err(); err != nil {
+		l.Error("Could not opt out", zap.Error(err))
+		return l.messageIn(locale, "optout.failed", &messageData{})
+	}
+	return l.messageIn(locale, "optout.done", &messageData{})
+}
+
+// 通知オン
+func (l *labbot) optInLINE(req *commandRequest) string {
+	locale := l.localeOfRequest(req)
+	if err := l.Redis.SRem(optOutKey, req.UserID).Err(); err != nil {
+		l.Error("Could not opt in", zap.Error(err))
+		return l.messageIn(locale, "optout.failed", &messageData{})
+	}
+	return l.messageIn(locale, "optin.done", &messageData{})
+}
+
+// multicastToLINE sends the message to members who follow the bot and don't opt out.
+func (l *labbot) multicastToLINE(msg string) error {
+	return l.multicastLocalized(func(string) string { return msg })
+}
+
+// multicastLocalized sends the message which is rendered in the locale of each member.
+// Failures of some chunks don't stop the others, and the last error is returned.
+func (l *labbot) multicastLocalized(render func(locale string) string) error {
+	members, err := l.members() // members.go
+	if err != nil {
+		return errors.Wrap(err, "Could not get members")
+	}
+	byLocale := make(map[string][]string)
+	for _, member := range members {
+		if !member.Active {
+			continue
+		}
+		optOut, err := l.Redis.SIsMember(optOutKey, member.UserID).Result()
+		if err != nil {
+			l.Warn("Could not get opt out", zap.Error(err))
+		}
+		if !optOut {
+			locale := l.memberLocale(member) // locale.go
+			byLocale[locale] = append(byLocale[locale], member.UserID)
+		}
+	}
+	var lastErr error
+	for locale, to := range byLocale {
+		msg := render(locale)
+		for i := 0; i < len(to); i += maxMulticast {
+			end := i + maxMulticast
+			if end > len(to) {
+				end = len(to)
+			}
+			if _, err := l.LINE.Multicast(to[i:end], linebot.NewTextMessage(msg)).Do(); err != nil {
+				l.Warn("Failed to multicast to LINE", zap.Error(err), zap.String("message", msg))
+				lastErr = errors.Wrap(err, "Failed to multicast to LINE")
+				continue
+			}
+			l.Info("Message successfully sent to LINE", zap.Int("recipients", end-i), zap.String("locale", locale))
+		}
+	}
+	return lastErr
+}
+
+var slackMarkup = regexp.MustCompile(`<![a-z]+(\|[^>]*)?>\s*`)
+
+// stripSlackMarkup removes mentions like "<!channel>" from the message for slack.
+func stripSlackMarkup(msg string) string {
+	return slackMarkup.ReplaceAllString(msg, "")
+}
@@ -0,0 +1,308 @@
+package labbot
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Locales of messages. Japanese is defaultMessages in persona.go
+const (
+	localeJa = "ja"
+	localeEn = "en"
+)
+
+// catalogs are messages in the other locales than Japanese
+var catalogs = map[string]map[string][]variant{
+	localeEn: englishMessages,
+}
+
+// localeFormat is the format of values which are embedded in messages
+type localeFormat struct {
+	time      string
+	date      string
+	separator string
+}
+
+var localeFormats = map[string]localeFormat{
+	localeJa: {time: tmformat, date: "2006年01月02日", separator: "、"},
+	localeEn: {time: "Jan 2, 2006 15:04", date: "Jan 2, 2006", separator: ", "},
+}
+
+// isLocale reports whether messages in the locale are available.
+func isLocale(locale string) bool {
+	_, ok := localeFormats[locale]
+	return ok
+}
+
+// formatTime formats t for messages in the locale.
+func formatTime(locale string, t time.Time) string {
+	if format, ok := localeFormats[locale]; ok {
+		return t.Format(format.time)
+	}
+	return t.Format(tmformat)
+}
+
+// formatDate formats the date of t for messages in the locale.
+func formatDate(locale string, t time.Time) string {
+	if format, ok := localeFormats[locale]; ok {
+		return t.Format(format.date)
+	}
+	return t.Format(localeFormats[localeJa].date)
+}
+
+func listSeparator(locale string) string {
+	if format, ok := localeFormats[locale]; ok {
+		return format.separator
+	}
+	return localeFormats[localeJa].separator
+}
+
+var englishMessages = map[string][]variant{
+	// cron.go
+	"progress":           {{Text: "<!here> Hi everyone, how is your progress!?"}},
+	"seminar":            {{Text: "<!channel> Everyone, today is the seminar day!\nI'm cheering for you!"}},
+	"day-after-tomorrow": {{Text: "<!channel> The seminar is the day after tomorrow!"}},
+	"clean": {
+		{Text: "<!channel> Everyone! Are you cleaning the lab?\nPlease put the trash on your desk into the trash can!"},
+		{Text: "<!channel> Everyone! Are you cleaning the lab?\nPlease vacuum the floor once in a while!"},
+		{Text: "<!channel> Everyone! Are you cleaning the lab?\nI want you to relax in a clean room after the seminar."},
+		{Text: "<!channel> Everyone! Are you cleaning the lab?\nLet's wipe the desks sometimes!"},
+	},
+
+	// line-beacon.go
+	"enter.morning":  {{Text: "Good morning, {{.Name}}♡"}},
+	"enter.daytime":  {{Text: "Hello, {{.Name}}♡"}},
+	"enter.night":    {{Text: "Good evening, {{.Name}}♡"}},
+	"enter.midnight": {{Text: "Thank you for working so late, {{.Name}}♡"}},
+	"leave.short":    {{Text: "Good work today, {{.Name}}!"}},
+	"leave.long":     {{Text: "{{.Name}}, you worked really hard… I respect you!"}},
+	"leave.overwork": {{Text: "{{.Name}}, please don't work yourself to death!"}},
+	"welcome":        {{Text: "{{.Name}} came to {{.Room}} at {{.Time}}♡"}},
+	"seeyou":         {{Text: "{{.Name}} left {{.Room}} at {{.Time}}♡"}},
+	"move":           {{Text: "{{.Name}} moved from {{.From}} to {{.Room}} at {{.Time}}♡"}},
+
+	// chat.go
+	"choice.join":     {{Text: "Join"}},
+	"choice.not-join": {{Text: "Not join"}},
+	"choice.approve":  {{Text: "Approve"}},
+	"choice.reject":   {{Text: "Reject"}},
+	"reply.join":      {{Text: "Have fun!"}},
+	"reply.not-join":  {{Text: "That's too bad…"}},
+	"usage.iam":       {{Text: "Please tell me your name on LINE (e.g. iam Chihiro)"}},
+	"usage.pin":       {{Text: "Please tell me the PIN secretly by DM (e.g. pin 1234)"}},
+	"usage.qr":        {{Text: "Please ask me for the QR code token by DM"}},
+	"usage.mac":       {{Text: "Please tell me the MAC address of your device (e.g. mac aa:bb:cc:dd:ee:ff)"}},
+	"usage.command":   {{Text: "Usage: /labbot in [--at 09:30], /labbot out [--at 18:00], /labbot pin 1234, /labbot qr, /labbot mac aa:bb:cc:dd:ee:ff"}},
+
+	// commands.go
+	"people.room":      {{Text: "{{.Names}} in {{.Room}}!"}},
+	"people.nobody":    {{Text: "Nobody seems to be here now…"}},
+	"week":             {{Text: "{{.Name}} was in the lab for {{.Hours}}h {{.Minutes}}m this week!"}},
+	"seminar.next":     {{Text: "The next seminar is on {{.Time}}!"}},
+	"seminar.failed":   {{Text: "Sorry, I couldn't find the seminar schedule…"}},
+	"usage.whoisthere": {{Text: "\"who is here\""}},
+	"usage.week":       {{Text: "\"this week\""}},
+	"usage.seminar":    {{Text: "\"next seminar\""}},
+
+	// checkin.go
+	"member.unknown":          {{Text: "Sorry, I couldn't find out who you are…"}},
+	"link.done":               {{Text: "You are {{.Name}}! I'll remember it♡"}},
+	"link.failed":             {{Text: "Sorry, I couldn't remember it…"}},
+	"link.requested":          {{Text: "{{.Name}} is linked with another account, so I asked the administrators! Please wait a moment"}},
+	"link.request":            {{Text: "{{.Value}} wants to be linked as {{.Name}}, who is linked with another account"}},
+	"link.rejected":           {{Text: "Your request to be linked as {{.Name}} is rejected…"}},
+	"check.usage":             {{Text: "Please tell me in or out"}},
+	"check.unknown":           {{Text: "I don't understand {{.Value}}… Please tell me in or out"}},
+	"check.unknown-option":    {{Text: "I don't understand {{.Value}}…"}},
+	"check.no-time":           {{Text: "Please give the time to --at (e.g. --at 09:30)"}},
+	"check.invalid-time":      {{Text: "I can't read {{.Value}} as a time (e.g. --at 09:30)"}},
+	"check.before-last":       {{Text: "{{.Value}} is before your last record…"}},
+	"check.already-in":        {{Text: "{{.Name}}, you are already in the lab?"}},
+	"check.not-in":            {{Text: "{{.Name}}, you haven't come to the lab yet?"}},
+	"check.failed":            {{Text: "Sorry, I couldn't record it…"}},
+	"approval.in":             {{Text: "{{.Name}} requests to record coming at {{.Time}}"}},
+	"approval.out":            {{Text: "{{.Name}} requests to record leaving at {{.Time}}"}},
+	"approval.requested":      {{Text: "I asked the administrators for approval! Please wait a moment"}},
+	"approval.request-failed": {{Text: "Sorry, I couldn't ask the administrators…"}},
+	"approval.admin-only":     {{Text: "Only administrators can approve it"}},
+	"approval.handled":        {{Text: "This request has already been handled"}},
+	"approval.failed":         {{Text: "I couldn't read the request…"}},
+	"approval.approve":        {{Text: "Approved"}},
+	"approval.reject":         {{Text: "Rejected"}},
+	"approval.approved":       {{Text: "Your request of {{.Time}} is approved!"}},
+	"approval.rejected":       {{Text: "Your request of {{.Time}} is rejected…"}},
+
+	// line.go
+	"help":           {{Text: "Sorry, I didn't understand…\nPlease ask me {{.Names}}♡"}},
+	"greet.group":    {{Text: "I'm {{.Bot}}! Nice to meet you♡\nIf you want to receive announcements, please add me as a friend"}},
+	"optout.done":    {{Text: "I stopped sending announcements. Tell me \"notifications on\" when you want them again"}},
+	"optin.done":     {{Text: "I'll send you announcements♡"}},
+	"optout.failed":  {{Text: "Sorry, I couldn't change the setting…"}},
+	"usage.opt-out":  {{Text: "\"notifications off\""}},
+	"usage.opt-in":   {{Text: "\"notifications on\""}},
+	"usage.checkin":  {{Text: "\"check in\""}},
+	"usage.checkout": {{Text: "\"check out\""}},
+	"usage.english":  {{Text: "\"English\""}},
+	"usage.japanese": {{Text: "\"日本語\""}},
+
+	// kiosk.go
+	"pin.short":         {{Text: "Please make the PIN 4 digits or more"}},
+	"pin.set":           {{Text: "I registered the PIN of {{.Name}}♡"}},
+	"pin.failed":        {{Text: "Sorry, I couldn't register the PIN…"}},
+	"pin.locked":        {{Text: "The PIN was wrong too many times, please try again later"}},
+	"pin.not-set":       {{Text: "The PIN is not registered"}},
+	"pin.wrong":         {{Text: "The PIN is wrong"}},
+	"qr.unavailable":    {{Text: "QR codes are not available"}},
+	"qr.disabled":       {{Text: "QR codes are disabled…"}},
+	"qr.unreadable":     {{Text: "I can't read the QR code"}},
+	"qr.invalid":        {{Text: "The QR code is invalid"}},
+	"qr.expired":        {{Text: "The QR code has expired"}},
+	"qr.revoked":        {{Text: "This QR code is no longer valid"}},
+	"qr.token":          {{Text: "Here is the token for the QR code of {{.Name}}♡ The previous token is no longer valid\n```{{.Value}}```"}},
+	"qr.failed":         {{Text: "Sorry, I couldn't issue the token…"}},
+	"kiosk.bad-request": {{Text: "I can't read the request"}},
+	"kiosk.bad-action":  {{Text: "action must be in, out or toggle"}},
+	"kiosk.failed":      {{Text: "Sorry, I couldn't check it…"}},
+
+	// network.go
+	"mac.invalid":    {{Text: "I can't read {{.Value}} as a MAC address…"}},
+	"mac.registered": {{Text: "I registered the device {{.Value}} of {{.Name}}♡"}},
+	"mac.failed":     {{Text: "Sorry, I couldn't register it…"}},
+
+	// members.go
+	"members.member":       {{Text: "{{.Name}} `{{.Value}}` since {{.Time}}"}},
+	"members.blocked":      {{Text: "{{.Name}} `{{.Value}}` since {{.Time}} (blocked)"}},
+	"members.unknown-time": {{Text: "unknown"}},
+	"members.empty":        {{Text: "Nobody is registered yet…"}},
+	"members.admin-only":   {{Text: "Sorry, only administrators can see the members…"}},
+	"members.failed":       {{Text: "Sorry, I couldn't read the members…"}},
+
+	// history.go
+	"source.beacon":  {{Text: "LINE Beacon"}},
+	"source.manual":  {{Text: "Manual"}},
+	"source.kiosk":   {{Text: "Kiosk"}},
+	"source.network": {{Text: "Network"}},
+	"source.line":    {{Text: "LINE menu"}},
+
+	// jobs.go
+	"jobs.job":          {{Text: "`{{.Name}}` next {{.Time}} / {{.Value}}"}},
+	"jobs.never":        {{Text: "not run yet"}},
+	"jobs.last-success": {{Text: "last {{.Time}} succeeded"}},
+	"jobs.last-skipped": {{Text: "last {{.Time}} skipped"}},
+	"jobs.last-failure": {{Text: "last {{.Time}} failed ({{.Count}} in a row: {{.Value}})"}},
+	"jobs.failed":       {{Text: "Sorry, I couldn't read the records of jobs…"}},
+	"jobs.alert":        {{Text: "The job {{.Name}} failed {{.Count}} times in a row… Could you check it?\n{{.Value}}"}},
+
+	// timequery.go
+	"history.who-at":         {{Text: "{{.Names}} in the lab at {{.Time}}!"}},
+	"history.nobody-at":      {{Text: "Nobody seems to have been in the lab at {{.Time}}…"}},
+	"history.who-on":         {{Text: "{{.Names}} came to the lab on {{.Time}}!"}},
+	"history.nobody-on":      {{Text: "Nobody seems to have come to the lab on {{.Time}}…"}},
+	"history.came":           {{Text: "{{.Name}} came at {{.Time}}!"}},
+	"history.left":           {{Text: "{{.Name}} left at {{.Time}}!"}},
+	"history.not-came":       {{Text: "{{.Name}} doesn't seem to have come on {{.Time}}…"}},
+	"history.not-left":       {{Text: "{{.Name}} doesn't seem to have left on {{.Time}}…"}},
+	"history.unknown-member": {{Text: "Sorry, I don't know who you mean…"}},
+	"history.failed":         {{Text: "Sorry, I couldn't read the records…"}},
+
+	// subscription.go
+	"notify.once":      {{Text: "I'll let you know when {{if .Name}}{{.Name}}{{else}}someone{{end}} arrives♡ (until {{.Time}})"}},
+	"notify.every":     {{Text: "I'll let you know every time {{if .Name}}{{.Name}}{{else}}someone{{end}} arrives until {{.Time}}♡"}},
+	"notify.arrived":   {{Text: "{{.Name}} has arrived at {{.Room}} at {{.Time}}♡"}},
+	"notify.cancelled": {{Text: "I stopped the notifications"}},
+	"notify.failed":    {{Text: "Sorry, I couldn't remember it…"}},
+
+	// lastout.go
+	"lastout.title":     {{Text: "Lock-up check"}},
+	"lastout.checklist": {{Text: "{{.Name}}, you are the last one to leave!\nPlease check: {{.Names}}♡"}},
+	"choice.lastout":    {{Text: "Checked"}},
+	"lastout.acked":     {{Text: "Thank you! Get home safely♡"}},
+	"lastout.expired":   {{Text: "It has already been checked, or has timed out…"}},
+	"lastout.escalated": {{Text: "<!channel> {{.Name}} left the lab last at {{.Time}}, but {{.Names}} haven't been checked yet… Could someone check them?"}},
+
+	// locale.go
+	"locale.set":       {{Text: "OK, I'll talk to you in English♡"}},
+	"locale.usage":     {{Text: "Please tell me \"lang en\" or \"lang ja\""}},
+	"locale.no-member": {{Text: "Sorry, I couldn't find you in LINE friends… Please tell me your LINE name by \"iam <name>\""}},
+	"locale.failed":    {{Text: "Sorry, I couldn't save the setting…"}},
+}
+
+// memberLocale returns the locale of the member, or --locale if it is not set.
+func (l *labbot) memberLocale(member *Member) string {
+	if member != nil && isLocale(member.Locale) {
+		return member.Locale
+	}
+	return l.Locale
+}
+
+// localeOf returns the locale of the member who has the name.
+func (l *labbot) localeOf(name string) string {
+	member, err := l.findMember(name) // members.go
+	if err != nil {
+		l.Warn("Failed to find member", zap.String("name", name), zap.Error(err))
+	}
+	return l.memberLocale(member)
+}
+
+// localeOfRequest returns the locale of the member who sent the command.
+func (l *labbot) localeOfRequest(req *commandRequest) string {
+	name, err := req.member()
+	if err != nil {
+		return l.Locale
+	}
+	return l.localeOf(name)
+}
+
+// localeOfChatUser returns the locale of the member who is linked with the chat user.
+func (l *labbot) localeOfChatUser(userID string) string {
+	name, err := l.memberName(userID) // checkin.go
+	if err != nil {
+		return l.Locale
+	}
+	return l.localeOf(name)
+}
+
+// setLocale stores the locale of the member, and returns the reply in the new locale.
+func (l *labbot) setLocale(member *Member, locale string) string {
+	if !isLocale(locale) {
+		return l.messageIn(l.memberLocale(member), "locale.usage", &messageData{})
+	}
+	member.Locale = locale
+	if err := l.storeMember(member); err != nil {
+		l.Error("Could not set locale", zap.Error(err))
+		return l.messageIn(l.memberLocale(member), "locale.failed", &messageData{})
+	}
+	return l.messageIn(locale, "locale.set", &messageData{Name: member.DisplayName})
+}
+
+// setChatLocale handles "lang" command from chat user, who is linked with LINE member by "iam".
+func (l *labbot) setChatLocale(userID string, args []string) string {
+	if len(args) < 2 {
+		return l.message("locale.usage", &messageData{})
+	}
+	name, err := l.memberName(userID) // checkin.go
+	if err != nil {
+		l.Error("Could not find member name", zap.Error(err))
+		return l.message("locale.no-member", &messageData{})
+	}
+	member, err := l.findMember(name)
+	if err != nil {
+		l.Error("Failed to find member", zap.Error(err))
+		return l.message("locale.failed", &messageData{})
+	}
+	if member == nil {
+		return l.message("locale.no-member", &messageData{})
+	}
+	return l.setLocale(member, args[1])
+}
+
+// English, 日本語 on LINE
+func (l *labbot) setLINELocale(req *commandRequest, locale string) string {
+	member, err := l.member(req.UserID)
+	if err != nil {
+		l.Error("Could not find member", zap.Error(err))
+		return l.messageIn(locale, "locale.failed", &messageData{})
+	}
+	return l.setLocale(member, locale)
+}
@@ -0,0 +1,76 @@
+package labbot
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestCatalogsHaveAllMessages(t *testing.T) {
+	for locale, catalog := range catalogs {
+		for id := range defaultMessages {
+			if _, ok := catalog[id]; !ok {
+				t.Errorf("%s doesn't have message %s", locale, id)
+			}
+		}
+		for id := range catalog {
+			if _, ok := defaultMessages[id]; !ok {
+				t.Errorf("%s has unknown message %s", locale, id)
+			}
+		}
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	p, err := loadPersona("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &labbot{persona: p, Logger: zap.NewNop()}
+
+	tests := []struct {
+		locale string
+		err    error
+		want   string
+	}{
+		{localeJa, newMessageError("pin.wrong", &messageData{}), "PINが違います"},
+		{localeEn, newMessageError("pin.wrong", &messageData{}), "The PIN is wrong"},
+		{localeEn, newMessageError("check.invalid-time", &messageData{Value: "25:00"}), "I can't read 25:00 as a time (e.g. --at 09:30)"},
+		// Errors which users cannot fix are not shown
+		{localeJa, errors.New("connection refused"), "ごめんなさい、確認できませんでした…"},
+	}
+	for _, tt := range tests {
+		if got := l.errorMessage(tt.locale, tt.err, "kiosk.failed"); got != tt.want {
+			t.Errorf("errorMessage(%s, %v) = %q, want %q", tt.locale, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestGreetGroupWithNickname(t *testing.T) {
+	p, err := loadPersona("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &labbot{persona: p, Logger: zap.NewNop()}
+	if got := l.messageIn(localeEn, "greet.group", &messageData{}); !strings.HasPrefix(got, "I'm Chihiro!") {
+		t.Errorf("greet.group = %q", got)
+	}
+
+	// Custom personas introduce themselves by their own name
+	path := filepath.Join(t.TempDir(), "persona.json")
+	if err := ioutil.WriteFile(path, []byte(`{"name": "tamaki", "nicknames": {"ja": "環"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if l.persona, err = loadPersona(path); err != nil {
+		t.Fatal(err)
+	}
+	for locale, want := range map[string]string{localeJa: "環です！", localeEn: "I'm 環!"} {
+		if got := l.messageIn(locale, "greet.group", &messageData{}); !strings.HasPrefix(got, want) {
+			t.Errorf("greet.group in %s = %q, want %s...", locale, got, want)
+		}
+	}
+}
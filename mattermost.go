@@ -0,0 +1,414 @@
+package labbot
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+type mattermostConfig struct {
+	// URL of mattermost server, e.g. https://mattermost.example.com
+	URL string
+	// Token is the access token of the bot account
+	Token string
+	// Team is the name of team where channels are found
+	Team string
+	// HookToken is the token of outgoing webhook
+	HookToken string
+	// CommandToken is the token of slash command
+	CommandToken string
+	// PublicURL is the url of labbot, which is used as the url of buttons
+	PublicURL string
+	// ActionSecret signs the context of buttons, because the context can be read
+	// by members of the channel. Instances behind the same URL must share it.
+	ActionSecret string
+	// Work is in-flight mentions which are waited on shutdown
+	Work *sync.WaitGroup
+}
+
+// mattermostAdapter is ChatAdapter for mattermost.
+// Messages are posted by API v4, and mentions are received by outgoing webhook
+// whose trigger word is "@chihiro".
+type mattermostAdapter struct {
+	config *mattermostConfig
+	client *http.Client
+	*zap.Logger
+
+	mu    sync.Mutex
+	botID string
+}
+
+func newMattermostAdapter(config *mattermostConfig, client *http.Client, logger *zap.Logger) *mattermostAdapter {
+	if config.ActionSecret == "" {
+		logger.Warn("MATTERMOST_ACTION_SECRET is not set, buttons work only until restart")
+		config.ActionSecret = newRandomID() // subscription.go
+	}
+	if config.HookToken == "" {
+		logger.Warn("MATTERMOST_HOOK_TOKEN is not set, mentions are rejected")
+	}
+	if config.CommandToken == "" {
+		logger.Warn("MATTERMOST_COMMAND_TOKEN is not set, slash commands are rejected")
+	}
+	if config.Work == nil {
+		config.Work = new(sync.WaitGroup)
+	}
+	return &mattermostAdapter{
+		config: config,
+		client: client,
+		Logger: logger,
+	}
+}
+
+func (m *mattermostAdapter) Name() string { return "mattermost" }
+
+// Listen does nothing, because mentions are received by outgoing webhook.
+func (m *mattermostAdapter) Listen(h ChatHandler) error {
+	return nil
+}
+
+func (m *mattermostAdapter) Ping() error {
+	return m.call(http.MethodGet, "/users/me", nil, nil)
+}
+
+// Close does nothing, because there is no connection.
+func (m *mattermostAdapter) Close() error { return nil }
+
+// Connected is always true, because outgoing webhook does not need connection.
+func (m *mattermostAdapter) Connected() bool { return true }
+
+// call calls mattermost API v4, and decodes the response to v if it is not nil.
+func (m *mattermostAdapter) call(method, path string, body, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return errors.Wrap(err, "JSON Marshal error")
+		}
+		r = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(m.config.URL, "/")+"/api/v4"+path, r)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create request")
+	}
+	req.Header.Set("Authorization", "Bearer "+m.config.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := m.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to call %s %s", method, path)
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(res.Body).Decode(&apiErr)
+		return fmt.Errorf("mattermost %s %s: %d %s", method, path, res.StatusCode, apiErr.Message)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+type mattermostUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Nickname string `json:"nickname"`
+}
+
+type mattermostAction struct {
+	Name        string                `json:"name"`
+	Style       string                `json:"style,omitempty"`
+	Integration mattermostIntegration `json:"integration"`
+}
+
+type mattermostIntegration struct {
+	URL     string            `json:"url"`
+	Context map[string]string `json:"context"`
+}
+
+type mattermostAttachment struct {
+	Text    string             `json:"text"`
+	Color   string             `json:"color,omitempty"`
+	Footer  string             `json:"footer,omitempty"`
+	Actions []mattermostAction `json:"actions,omitempty"`
+}
+
+// mattermostMarkup converts mentions for slack to mattermost
+var mattermostMarkup = strings.NewReplacer("<!channel>", "@channel", "<!here>", "@here")
+
+func (m *mattermostAdapter) PostMessage(channelID string, msg *ChatMessage) error {
+	post := map[string]interface{}{
+		"channel_id": channelID,
+		"message":    mattermostMarkup.Replace(msg.Text),
+	}
+	if a := msg.Attachment; a != nil {
+		attachment := mattermostAttachment{
+			Text:   mattermostMarkup.Replace(a.Text),
+			Color:  a.Color,
+			Footer: a.Footer,
+		}
+		for _, choice := range a.Choices {
+			attachment.Actions = append(attachment.Actions, mattermostAction{
+				Name:  choice.Text,
+				Style: choice.Style,
+				Integration: mattermostIntegration{
+					URL: strings.TrimRight(m.config.PublicURL, "/") + "/mattermost_action",
+					Context: m.signAction(map[string]string{
+						"callback_id": a.CallbackID,
+						"name":        choice.Name,
+						"value":       choice.Value,
+						"text":        a.Text,
+					}),
+				},
+			})
+		}
+		post["props"] = map[string]interface{}{
+			"attachments": []mattermostAttachment{attachment},
+		}
+	}
+	return m.call(http.MethodPost, "/posts", post, nil)
+}
+
+// actionFields are the context of buttons which are signed
+var actionFields = []string{"callback_id", "name", "value", "text"}
+
+func (m *mattermostAdapter) actionSignature(context map[string]string) string {
+	mac := hmac.New(sha256.New, []byte(m.config.ActionSecret))
+	for _, field := range actionFields {
+		mac.Write([]byte(context[field]))
+		mac.Write([]byte{0})
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signAction adds the signature to the context, so that nobody can forge the choice.
+func (m *mattermostAdapter) signAction(context map[string]string) map[string]string {
+	context["signature"] = m.actionSignature(context)
+	return context
+}
+
+func (m *mattermostAdapter) verifyAction(context map[string]string) bool {
+	return hmac.Equal([]byte(context["signature"]), []byte(m.actionSignature(context)))
+}
+
+func (m *mattermostAdapter) FindUserID(name string) (string, error) {
+	var user mattermostUser
+	if err := m.call(http.MethodGet, "/users/username/"+url.PathEscape(name), nil, &user); err != nil {
+		return "", errors.Wrapf(err, "Could not find id for %s", name)
+	}
+	return user.ID, nil
+}
+
+func (m *mattermostAdapter) FindChannelID(name string) (string, error) {
+	var channel struct {
+		ID string `json:"id"`
+	}
+	path := fmt.Sprintf("/teams/name/%s/channels/name/%s", url.PathEscape(m.config.Team), url.PathEscape(name))
+	if err := m.call(http.MethodGet, path, nil, &channel); err != nil {
+		return "", errors.Wrapf(err, "Could not find ChannelID of ~%s", name)
+	}
+	return channel.ID, nil
+}
+
+func (m *mattermostAdapter) DirectChannelID(userID string) (string, error) {
+	botID, err := m.getBotID()
+	if err != nil {
+		return "", err
+	}
+	var channel struct {
+		ID string `json:"id"`
+	}
+	if err := m.call(http.MethodPost, "/channels/direct", []string{botID, userID}, &channel); err != nil {
+		return "", errors.Wrap(err, "Failed to create direct channel")
+	}
+	return channel.ID, nil
+}
+
+// isDirect reports whether the channel is a direct message channel.
+func (m *mattermostAdapter) isDirect(channelID string) (bool, error) {
+	var channel struct {
+		Type string `json:"type"`
+	}
+	if err := m.call(http.MethodGet, "/channels/"+url.PathEscape(channelID), nil, &channel); err != nil {
+		return false, errors.Wrap(err, "Failed to get channel")
+	}
+	return channel.Type == "D", nil
+}
+
+func (m *mattermostAdapter) getBotID() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.botID != "" {
+		return m.botID, nil
+	}
+	var me mattermostUser
+	if err := m.call(http.MethodGet, "/users/me", nil, &me); err != nil {
+		return "", errors.Wrap(err, "Could not get the bot id")
+	}
+	m.botID = me.ID
+	return m.botID, nil
+}
+
+func (m *mattermostAdapter) User(userID string) (*ChatUser, error) {
+	var user mattermostUser
+	if err := m.call(http.MethodGet, "/users/"+url.PathEscape(userID), nil, &user); err != nil {
+		return nil, errors.Wrap(err, "Failed to get mattermost user")
+	}
+	return &ChatUser{
+		ID:          user.ID,
+		Name:        user.Username,
+		DisplayName: user.Nickname,
+	}, nil
+}
+
+func (m *mattermostAdapter) RegisterHandlers(mux *http.ServeMux, h ChatHandler) {
+	mux.HandleFunc("/mattermost", func(w http.ResponseWriter, r *http.Request) {
+		m.outgoing(w, r, h)
+	})
+	mux.HandleFunc("/mattermost_action", func(w http.ResponseWriter, r *http.Request) {
+		m.action(w, r, h)
+	})
+	mux.HandleFunc("/mattermost_command", func(w http.ResponseWriter, r *http.Request) {
+		m.slashCommand(w, r, h)
+	})
+}
+
+// "/mattermost" handler for outgoing webhook
+func (m *mattermostAdapter) outgoing(w http.ResponseWriter, r *http.Request, h ChatHandler) {
+	if r.Method != http.MethodPost {
+		m.Error("Invalid method", zap.String("method", r.Method), zap.String("expected", "POST"))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var hook struct {
+		Token       string `json:"token"`
+		ChannelID   string `json:"channel_id"`
+		UserID      string `json:"user_id"`
+		Text        string `json:"text"`
+		TriggerWord string `json:"trigger_word"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+			m.Error("Failed to decode json message from mattermost", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			m.Error("Failed to parse form", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		hook.Token = r.PostForm.Get("token")
+		hook.ChannelID = r.PostForm.Get("channel_id")
+		hook.UserID = r.PostForm.Get("user_id")
+		hook.Text = r.PostForm.Get("text")
+		hook.TriggerWord = r.PostForm.Get("trigger_word")
+	}
+
+	// Only accept message from mattermost with valid token
+	if m.config.HookToken == "" || hook.Token != m.config.HookToken {
+		m.Error("Invalid token", zap.String("token", hook.Token))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	m.config.Work.Add(1) // wait on shutdown
+	go func() {
+		defer m.config.Work.Done()
+		// "pin" and "qr" are answered only in direct messages
+		direct, err := m.isDirect(hook.ChannelID)
+		if err != nil {
+			m.Warn("Failed to get channel type", zap.String("channel", hook.ChannelID), zap.Error(err))
+		}
+		h.OnMention(&Mention{
+			Channel: hook.ChannelID,
+			User:    hook.UserID,
+			Text:    strings.TrimSpace(strings.Replace(hook.Text, hook.TriggerWord, "", 1)),
+			Direct:  direct,
+		})
+	}()
+}
+
+// "/mattermost_action" handler for buttons
+func (m *mattermostAdapter) action(w http.ResponseWriter, r *http.Request, h ChatHandler) {
+	if r.Method != http.MethodPost {
+		m.Error("Invalid method", zap.String("method", r.Method), zap.String("expected", "POST"))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		UserID  string            `json:"user_id"`
+		Context map[string]string `json:"context"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		m.Error("Failed to decode json message from mattermost", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// The context of button is signed by PostMessage
+	if !m.verifyAction(req.Context) {
+		m.Error("Invalid signature of action", zap.String("user", req.UserID))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	title := h.OnChoice(&ChoiceEvent{
+		CallbackID: req.Context["callback_id"],
+		Name:       req.Context["name"],
+		Value:      req.Context["value"],
+		UserID:     req.UserID,
+	})
+	if title == "" {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Replace the buttons with the result
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"update": map[string]interface{}{
+			"message": req.Context["text"] + "\n**" + title + "**",
+			"props":   map[string]interface{}{},
+		},
+	})
+}
+
+// "/mattermost_command" handler for "/labbot in --at 09:30" etc.
+func (m *mattermostAdapter) slashCommand(w http.ResponseWriter, r *http.Request, h ChatHandler) {
+	if r.Method != http.MethodPost {
+		m.Error("Invalid method", zap.String("method", r.Method), zap.String("expected", "POST"))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		m.Error("Failed to parse form", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Only accept command from mattermost with valid token
+	if token := r.PostForm.Get("token"); m.config.CommandToken == "" || token != m.config.CommandToken {
+		m.Error("Invalid token", zap.String("token", token))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	text := h.OnCommand(r.PostForm.Get("user_id"), r.PostForm.Get("text"))
+	writeCommandResponse(w, text) // slack.go
+}
@@ -0,0 +1,305 @@
+package labbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/labbot/internal/testserver"
+	"go.uber.org/zap"
+)
+
+// chatRecorder is ChatHandler which records events
+type chatRecorder struct {
+	mentions chan *Mention
+	choices  []*ChoiceEvent
+}
+
+func (h *chatRecorder) OnMention(m *Mention) { h.mentions <- m }
+
+func (h *chatRecorder) OnChoice(c *ChoiceEvent) string {
+	h.choices = append(h.choices, c)
+	return "承認しました"
+}
+
+func (h *chatRecorder) OnCommand(userID, text string) string { return userID + ":" + text }
+
+func newTestMattermost(t *testing.T) (*testserver.Mattermost, *mattermostAdapter, *httptest.Server, *chatRecorder) {
+	return newTestMattermostWithTokens(t, "hook-token", "command-token")
+}
+
+func newTestMattermostWithTokens(t *testing.T, hookToken, commandToken string) (*testserver.Mattermost, *mattermostAdapter, *httptest.Server, *chatRecorder) {
+	fake := testserver.NewMattermost()
+	fake.AddUser("UALICE", "alice", "ありす")
+	m := newMattermostAdapter(&mattermostConfig{
+		URL:          fake.URL,
+		Token:        fake.Token,
+		Team:         testserver.MattermostTeam,
+		HookToken:    hookToken,
+		CommandToken: commandToken,
+		PublicURL:    "https://labbot.example.com/",
+		ActionSecret: "action-secret",
+	}, http.DefaultClient, zap.NewNop())
+	h := &chatRecorder{mentions: make(chan *Mention, 1)}
+	mux := http.NewServeMux()
+	m.RegisterHandlers(mux, h)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		srv.Close()
+		fake.Close()
+	})
+	return fake, m, srv, h
+}
+
+func TestMattermostLookup(t *testing.T) {
+	_, m, _, _ := newTestMattermost(t)
+
+	if err := m.Ping(); err != nil {
+		t.Fatalf("Ping() = %v", err)
+	}
+	if id, err := m.FindUserID("alice"); err != nil || id != "UALICE" {
+		t.Errorf("FindUserID() = %q, %v, want UALICE", id, err)
+	}
+	if _, err := m.FindUserID("bob"); err == nil {
+		t.Error("FindUserID() of unknown user should fail")
+	}
+	if id, err := m.FindChannelID("timestamp"); err != nil || id != "CTIMESTAMP" {
+		t.Errorf("FindChannelID() = %q, %v, want CTIMESTAMP", id, err)
+	}
+	user, err := m.User("UALICE")
+	if err != nil || user.Name != "alice" || user.DisplayName != "ありす" {
+		t.Errorf("User() = %+v, %v", user, err)
+	}
+
+	dm, err := m.DirectChannelID("UALICE")
+	if err != nil {
+		t.Fatalf("DirectChannelID() = %v", err)
+	}
+	if direct, err := m.isDirect(dm); err != nil || !direct {
+		t.Errorf("isDirect(%s) = %v, %v, want true", dm, direct, err)
+	}
+	if direct, err := m.isDirect("CGENERAL"); err != nil || direct {
+		t.Errorf("isDirect(CGENERAL) = %v, %v, want false", direct, err)
+	}
+}
+
+func TestMattermostPostMessage(t *testing.T) {
+	fake, m, _, _ := newTestMattermost(t)
+
+	err := m.PostMessage("CGENERAL", &ChatMessage{
+		Text: "<!channel> みなさん",
+		Attachment: &ChatAttachment{
+			Text:       "申請です",
+			CallbackID: "backdate",
+			Choices: []Choice{
+				{Name: actionApprove, Text: "承認する", Style: "primary", Value: "id1"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("PostMessage() = %v", err)
+	}
+	posts := fake.Posts()
+	if len(posts) != 1 {
+		t.Fatalf("posts = %d, want 1", len(posts))
+	}
+	post := posts[0]
+	if post.ChannelID != "CGENERAL" || post.Message != "@channel みなさん" {
+		t.Errorf("post = %+v", post)
+	}
+	action := post.Props.Attachments[0].Actions[0]
+	if action.Integration.URL != "https://labbot.example.com/mattermost_action" {
+		t.Errorf("url = %s", action.Integration.URL)
+	}
+	if action.Integration.Context["signature"] == "" {
+		t.Error("context is not signed")
+	}
+	// Members of the channel can read the context
+	for _, call := range fake.CallsTo("/api/v4/posts") {
+		if bytes.Contains(call.Body, []byte("hook-token")) {
+			t.Error("hook token is posted to the channel")
+		}
+	}
+}
+
+func TestMattermostAction(t *testing.T) {
+	fake, m, srv, h := newTestMattermost(t)
+
+	m.PostMessage("CGENERAL", &ChatMessage{
+		Attachment: &ChatAttachment{
+			Text:       "申請です",
+			CallbackID: "backdate",
+			Choices:    []Choice{{Name: actionApprove, Text: "承認する", Value: "id1"}},
+		},
+	})
+	signed := fake.Posts()[0].Props.Attachments[0].Actions[0].Integration.Context
+
+	forged := make(map[string]string)
+	for k, v := range signed {
+		forged[k] = v
+	}
+	forged["value"] = "id2"
+
+	tests := []struct {
+		name    string
+		context map[string]string
+		want    int
+	}{
+		{"signed", signed, http.StatusOK},
+		{"forged value", forged, http.StatusUnauthorized},
+		{"hook token", map[string]string{"token": "hook-token", "name": actionApprove, "value": "id1"}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		body, _ := json.Marshal(map[string]interface{}{"user_id": "UALICE", "context": tt.context})
+		res, err := http.Post(srv.URL+"/mattermost_action", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, res.StatusCode, tt.want)
+		}
+	}
+	if len(h.choices) != 1 {
+		t.Fatalf("choices = %d, want 1", len(h.choices))
+	}
+	if c := h.choices[0]; c.Name != actionApprove || c.Value != "id1" || c.UserID != "UALICE" || c.CallbackID != "backdate" {
+		t.Errorf("choice = %+v", c)
+	}
+}
+
+func TestMattermostOutgoing(t *testing.T) {
+	_, m, srv, h := newTestMattermost(t)
+	dm, err := m.DirectChannelID("UALICE")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		channel string
+		want    int
+		direct  bool
+	}{
+		{"channel", "hook-token", "CGENERAL", http.StatusOK, false},
+		{"direct message", "hook-token", dm, http.StatusOK, true},
+		{"invalid token", "command-token", "CGENERAL", http.StatusUnauthorized, false},
+	}
+	for _, tt := range tests {
+		form := url.Values{
+			"token":        {tt.token},
+			"channel_id":   {tt.channel},
+			"user_id":      {"UALICE"},
+			"text":         {"@chihiro pin 1234"},
+			"trigger_word": {"@chihiro"},
+		}
+		res, err := http.PostForm(srv.URL+"/mattermost", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, res.StatusCode, tt.want)
+			continue
+		}
+		if tt.want != http.StatusOK {
+			continue
+		}
+		select {
+		case mention := <-h.mentions:
+			if mention.Channel != tt.channel || mention.User != "UALICE" || mention.Text != "pin 1234" || mention.Direct != tt.direct {
+				t.Errorf("%s: mention = %+v", tt.name, mention)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: no mention", tt.name)
+		}
+	}
+}
+
+func TestMattermostSlashCommand(t *testing.T) {
+	_, _, srv, _ := newTestMattermost(t)
+
+	for _, token := range []string{"command-token", "hook-token"} {
+		form := url.Values{"token": {token}, "user_id": {"UALICE"}, "text": {"in --at 09:30"}}
+		res, err := http.PostForm(srv.URL+"/mattermost_command", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		buf.ReadFrom(res.Body)
+		res.Body.Close()
+		if token == "hook-token" {
+			if res.StatusCode != http.StatusUnauthorized {
+				t.Errorf("status with hook token = %d, want 401", res.StatusCode)
+			}
+			continue
+		}
+		if !strings.Contains(buf.String(), "UALICE:in --at 09:30") {
+			t.Errorf("response = %s", buf.String())
+		}
+	}
+}
+
+func TestMattermostWithoutTokens(t *testing.T) {
+	_, _, srv, h := newTestMattermostWithTokens(t, "", "")
+
+	// Requests without token must not pass the empty token
+	for _, path := range []string{"/mattermost", "/mattermost_command"} {
+		form := url.Values{"user_id": {"UALICE"}, "text": {"@chihiro in"}, "trigger_word": {"@chihiro"}}
+		res, err := http.PostForm(srv.URL+path, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("status of %s = %d, want 401", path, res.StatusCode)
+		}
+	}
+	select {
+	case mention := <-h.mentions:
+		t.Errorf("mention = %+v, want nothing", mention)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMattermostOutgoingIsWaited(t *testing.T) {
+	_, m, srv, h := newTestMattermost(t)
+
+	form := url.Values{
+		"token":        {"hook-token"},
+		"channel_id":   {"CGENERAL"},
+		"user_id":      {"UALICE"},
+		"text":         {"@chihiro 誰がいる?"},
+		"trigger_word": {"@chihiro"},
+	}
+	// The mention is not received until the test reads it, like a slow reply
+	h.mentions = make(chan *Mention)
+	res, err := http.PostForm(srv.URL+"/mattermost", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	drained := make(chan struct{})
+	go func() {
+		m.config.Work.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		t.Fatal("shutdown doesn't wait for the mention")
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-h.mentions
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("the mention is not done")
+	}
+}
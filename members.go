@@ -0,0 +1,224 @@
+package labbot
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// membersKey is the hash of LINE user id and Member
+const membersKey = key + ":members"
+
+// Member is a lab member who follows the bot on LINE
+type Member struct {
+	UserID      string    `json:"user_id"`
+	DisplayName string    `json:"display_name"`
+	FollowedAt  time.Time `json:"followed_at"`
+	Active      bool      `json:"active"`
+	RefreshedAt time.Time `json:"refreshed_at"`
+	// Locale is the language of messages to the member, see locale.go
+	Locale string `json:"locale,omitempty"`
+}
+
+func (l *labbot) loadMember(userID string) (*Member, error) {
+	serialized, err := l.Redis.HGet(membersKey, userID).Result()
+	if err != nil {
+		return nil, err
+	}
+	member := new(Member)
+	if err := json.Unmarshal([]byte(serialized), member); err != nil {
+		return nil, errors.Wrap(err, "Could not unmarshal member")
+	}
+	return member, nil
+}
+
+func (l *labbot) storeMember(member *Member) error {
+	serialized, err := json.Marshal(member)
+	if err != nil {
+		return errors.Wrap(err, "JSON Marshal error")
+	}
+	if err := l.Redis.HSet(membersKey, member.UserID, string(serialized)).Err(); err != nil {
+		return errors.Wrap(err, "Could not set member to redis")
+	}
+	return nil
+}
+
+// refreshProfile fetches the current display name of the member from LINE.
+func (l *labbot) refreshProfile(member *Member) error {
+	res, err := l.LINE.GetProfile(member.UserID).Do()
+	if err != nil {
+		return errors.Wrap(err, "Failed to get user profile")
+	}
+	member.DisplayName = res.DisplayName
+	member.RefreshedAt = time.Now()
+	return l.storeMember(member)
+}
+
+// member returns the member with cached profile. The profile is fetched from LINE
+// when the member is unknown, or the cache is older than --profile-refresh.
+func (l *labbot) member(userID string) (*Member, error) {
+	if userID == "" {
+		return nil, errors.New("LINE user id is empty")
+	}
+	member, err := l.loadMember(userID)
+	if err == redis.Nil {
+		// The member who followed before the registry is made
+		member = &Member{UserID: userID, Active: true}
+		if err := l.refreshProfile(member); err != nil {
+			return nil, err
+		}
+		return member, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Since(member.RefreshedAt) > l.ProfileRefresh {
+		if err := l.refreshProfile(member); err != nil {
+			if member.DisplayName == "" {
+				// Presence must not be recorded without the name
+				return nil, err
+			}
+			// The cached name is better than nothing
+			l.Warn("Failed to refresh profile", zap.String("user", userID), zap.Error(err))
+		}
+	}
+	return member, nil
+}
+
+func (l *labbot) follow(userID string, at time.Time) {
+	member, err := l.loadMember(userID)
+	if err == redis.Nil {
+		member = &Member{UserID: userID}
+	} else if err != nil {
+		// Don't overwrite the record which could not be read
+		l.Error("Failed to load member", zap.String("user", userID), zap.Error(err))
+		return
+	}
+	member.Active = true
+	member.FollowedAt = at
+	if err := l.refreshProfile(member); err != nil {
+		// The follow is registered anyway, and RefreshedAt is left zero
+		// so that the profile is fetched later by member()
+		l.Warn("Failed to get profile of follower", zap.String("user", userID), zap.Error(err))
+		member.RefreshedAt = time.Time{}
+		if err := l.storeMember(member); err != nil {
+			l.Error("Failed to register member", zap.String("user", userID), zap.Error(err))
+		}
+	}
+}
+
+func (l *labbot) unfollow(userID string) {
+	member, err := l.loadMember(userID)
+	if err != nil {
+		l.Warn("Unknown member unfollowed", zap.String("user", userID), zap.Error(err))
+		return
+	}
+	member.Active = false
+	if err := l.storeMember(member); err != nil {
+		l.Error("Failed to deactivate member", zap.String("user", userID), zap.Error(err))
+	}
+}
+
+// members returns all members sorted by display name.
+func (l *labbot) members() ([]*Member, error) {
+	all, err := l.Redis.HGetAll(membersKey).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get members")
+	}
+	list := make([]*Member, 0, len(all))
+	for _, serialized := range all {
+		member := new(Member)
+		if err := json.Unmarshal([]byte(serialized), member); err != nil {
+			l.Warn("Could not unmarshal member", zap.Error(err))
+			continue
+		}
+		list = append(list, member)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].DisplayName < list[j].DisplayName
+	})
+	return list, nil
+}
+
+// findMember returns the member who has the display name, or nil if not found.
+func (l *labbot) findMember(name string) (*Member, error) {
+	list, err := l.members()
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range list {
+		if member.DisplayName == name {
+			return member, nil
+		}
+	}
+	return nil, nil
+}
+
+// refreshMembers refreshes profiles of all active members, it is run by cron.
+func (l *labbot) refreshMembers() error {
+	list, err := l.members()
+	if err != nil {
+		return errors.Wrap(err, "Failed to get members")
+	}
+	for _, member := range list {
+		if !member.Active {
+			continue
+		}
+		if err := l.refreshProfile(member); err != nil {
+			l.Warn("Failed to refresh profile", zap.String("user", member.UserID), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// migrateFollowers moves followers which are recorded before the member registry.
+func (l *labbot) migrateFollowers() {
+	followers, err := l.Redis.SMembers(followersKey).Result()
+	if err != nil || len(followers) == 0 {
+		return
+	}
+	for _, userID := range followers {
+		if _, err := l.member(userID); err != nil {
+			l.Warn("Failed to migrate follower", zap.String("user", userID), zap.Error(err))
+			return
+		}
+	}
+	l.Redis.Del(followersKey)
+	l.Info("migrated followers to members", zap.Int("count", len(followers)))
+}
+
+// membersMessage returns the list of members for administrators.
+func (l *labbot) membersMessage(userID string) string {
+	locale := l.localeOfChatUser(userID) // locale.go
+	if !l.isAdmin(userID) {
+		return l.messageIn(locale, "members.admin-only", &messageData{})
+	}
+	list, err := l.members()
+	if err != nil {
+		l.Error("Failed to get members", zap.Error(err))
+		return l.messageIn(locale, "members.failed", &messageData{})
+	}
+	if len(list) == 0 {
+		return l.messageIn(locale, "members.empty", &messageData{})
+	}
+	lines := make([]string, 0, len(list))
+	for _, member := range list {
+		data := &messageData{Name: member.DisplayName, Value: member.UserID}
+		if member.FollowedAt.IsZero() {
+			data.Time = l.messageIn(locale, "members.unknown-time", &messageData{})
+		} else {
+			data.Time = formatTime(locale, member.FollowedAt)
+		}
+		id := "members.member"
+		if !member.Active {
+			id = "members.blocked"
+		}
+		lines = append(lines, l.messageIn(locale, id, data))
+	}
+	return strings.Join(lines, "\n")
+}
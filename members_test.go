@@ -0,0 +1,39 @@
+package labbot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/labbot/internal/testserver"
+)
+
+func TestMemberWithoutProfile(t *testing.T) {
+	slack := testserver.NewSlack()
+	defer slack.Close()
+	line := testserver.NewLINE()
+	defer line.Close()
+	l, _ := newTestLabbot(t, slack, line)
+
+	// LINE doesn't return the profile of the follower yet
+	l.follow("U1", time.Now())
+	stored, err := l.loadMember("U1")
+	if err != nil {
+		t.Fatalf("follow() didn't register the member: %v", err)
+	}
+	if !stored.RefreshedAt.IsZero() {
+		t.Errorf("RefreshedAt = %v, want zero", stored.RefreshedAt)
+	}
+	if member, err := l.member("U1"); err == nil {
+		t.Errorf("member() = %+v, want error without the name", member)
+	}
+
+	// The profile is fetched once LINE returns it
+	line.AddProfile("U1", "ありす")
+	member, err := l.member("U1")
+	if err != nil {
+		t.Fatalf("member() = %v", err)
+	}
+	if member.DisplayName != "ありす" {
+		t.Errorf("DisplayName = %q, want ありす", member.DisplayName)
+	}
+}
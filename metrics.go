@@ -0,0 +1,193 @@
+package labbot
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics exported to "/metrics"
+var (
+	lineEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "labbot_line_events_total",
+		Help: "LINE webhook events by type.",
+	}, []string{"type"})
+
+	beaconEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "labbot_beacon_events_total",
+		Help: "LINE Beacon events by type, enter or leave.",
+	}, []string{"type"})
+
+	beaconFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "labbot_beacon_event_failures_total",
+		Help: "LINE Beacon events which failed to be handled.",
+	})
+
+	lineRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "labbot_line_api_requests_total",
+		Help: "LINE Messaging API requests by outcome, retries are counted once.",
+	}, []string{"outcome"})
+
+	lineRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "labbot_line_api_retries_total",
+		Help: "Retries of LINE Messaging API requests.",
+	})
+
+	chatCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "labbot_chat_api_calls_total",
+		Help: "Chat API calls by platform, method and outcome.",
+	}, []string{"platform", "method", "outcome"})
+
+	cronRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "labbot_cron_runs_total",
+		Help: "Cron job executions by job name.",
+	}, []string{"job"})
+
+	cronFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "labbot_cron_failures_total",
+		Help: "Cron job failures by job name.",
+	}, []string{"job"})
+
+	cronDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "labbot_cron_duration_seconds",
+		Help:    "Duration of cron jobs by job name.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"job"})
+
+	redisDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "labbot_redis_duration_seconds",
+		Help:    "Latency of redis operations by command.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"command"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "labbot_http_request_duration_seconds",
+		Help:    "Latency of http requests by route and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "code"})
+
+	peopleInLab = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "labbot_people_in_lab",
+		Help: "Current number of people in the lab.",
+	}, func() float64 {
+		return float64(countPeopleInLab()) // line-beacon.go
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		lineEvents,
+		beaconEvents,
+		beaconFailures,
+		lineRequests,
+		lineRetries,
+		chatCalls,
+		cronRuns,
+		cronFailures,
+		cronDuration,
+		redisDuration,
+		httpDuration,
+		peopleInLab,
+	)
+}
+
+// observeRedis records the latency of each redis command.
+func observeRedis(client *redis.Client) {
+	client.WrapProcess(func(process func(cmd redis.Cmder) error) func(cmd redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			start := time.Now()
+			err := process(cmd)
+			redisDuration.WithLabelValues(cmd.Name()).Observe(time.Since(start).Seconds())
+			return err
+		}
+	})
+}
+
+// statusRecorder keeps the status code for metrics
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// observeHTTP records the latency of requests by the pattern registered in mux.
+func observeHTTP(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unknown"
+		}
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		start := time.Now()
+		mux.ServeHTTP(rec, r)
+		httpDuration.WithLabelValues(route, strconv.Itoa(rec.code)).Observe(time.Since(start).Seconds())
+	})
+}
+
+// observedChat is ChatAdapter which counts API calls
+type observedChat struct {
+	ChatAdapter
+}
+
+func (o *observedChat) observe(method string, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	chatCalls.WithLabelValues(o.Name(), method, outcome).Inc()
+}
+
+func (o *observedChat) PostMessage(channelID string, msg *ChatMessage) error {
+	err := o.ChatAdapter.PostMessage(channelID, msg)
+	o.observe("PostMessage", err)
+	return err
+}
+
+func (o *observedChat) FindUserID(name string) (string, error) {
+	id, err := o.ChatAdapter.FindUserID(name)
+	o.observe("FindUserID", err)
+	return id, err
+}
+
+func (o *observedChat) FindChannelID(name string) (string, error) {
+	id, err := o.ChatAdapter.FindChannelID(name)
+	o.observe("FindChannelID", err)
+	return id, err
+}
+
+func (o *observedChat) DirectChannelID(userID string) (string, error) {
+	id, err := o.ChatAdapter.DirectChannelID(userID)
+	o.observe("DirectChannelID", err)
+	return id, err
+}
+
+func (o *observedChat) User(userID string) (*ChatUser, error) {
+	user, err := o.ChatAdapter.User(userID)
+	o.observe("User", err)
+	return user, err
+}
+
+func (o *observedChat) Ping() error {
+	err := o.ChatAdapter.Ping()
+	o.observe("Ping", err)
+	return err
+}
+
+// observeCron records the execution of the cron job.
+func observeCron(name string, run func() error) error {
+	cronRuns.WithLabelValues(name).Inc()
+	start := time.Now()
+	err := run()
+	cronDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		cronFailures.WithLabelValues(name).Inc()
+	}
+	return err
+}
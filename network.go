@@ -0,0 +1,236 @@
+package labbot
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const macKey = key + ":mac"
+
+// parseARP parses the format of /proc/net/arp, and returns MAC addresses.
+//
+//	IP address       HW type     Flags       HW address            Mask     Device
+//	192.168.0.10     0x1         0x2         aa:bb:cc:dd:ee:ff     *        eth0
+func parseARP(r io.Reader) ([]string, error) {
+	macs := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] == "IP" {
+			continue
+		}
+		// 0x0 means incomplete entry
+		if fields[2] == "0x0" {
+			continue
+		}
+		mac, err := net.ParseMAC(fields[3])
+		if err != nil || mac.String() == "00:00:00:00:00:00" {
+			continue
+		}
+		macs = append(macs, mac.String())
+	}
+	return macs, scanner.Err()
+}
+
+// parseDnsmasqLeases parses the format of dnsmasq.leases, and returns MAC addresses
+// of the leases which are not expired at now.
+//
+//	1508312345 aa:bb:cc:dd:ee:ff 192.168.0.10 hostname 01:aa:bb:cc:dd:ee:ff
+func parseDnsmasqLeases(r io.Reader, now time.Time) ([]string, error) {
+	macs := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		// 0 means infinite lease
+		if expiry != 0 && time.Unix(expiry, 0).Before(now) {
+			continue
+		}
+		mac, err := net.ParseMAC(fields[1])
+		if err != nil {
+			continue
+		}
+		macs = append(macs, mac.String())
+	}
+	return macs, scanner.Err()
+}
+
+type presenceChange struct {
+	Name  string
+	Inlab bool
+	At    time.Time
+}
+
+// networkCollector decides enter/leave of members from the observed devices.
+// Members must be seen for debounce before entering, and must be missing for
+// grace before leaving, so that short disconnections of Wi-Fi are ignored.
+type networkCollector struct {
+	debounce  time.Duration
+	grace     time.Duration
+	firstSeen map[string]time.Time
+	lastSeen  map[string]time.Time
+	present   map[string]bool
+}
+
+func newNetworkCollector(debounce, grace time.Duration) *networkCollector {
+	return &networkCollector{
+		debounce:  debounce,
+		grace:     grace,
+		firstSeen: make(map[string]time.Time),
+		lastSeen:  make(map[string]time.Time),
+		present:   make(map[string]bool),
+	}
+}
+
+// observe receives the names of members whose devices are seen at now,
+// and returns presence changes.
+func (c *networkCollector) observe(seen map[string]bool, now time.Time) []presenceChange {
+	changes := make([]presenceChange, 0)
+	for name := range seen {
+		c.lastSeen[name] = now
+		if c.present[name] {
+			continue
+		}
+		first, ok := c.firstSeen[name]
+		if !ok {
+			first = now
+			c.firstSeen[name] = now
+		}
+		if now.Sub(first) >= c.debounce {
+			c.present[name] = true
+			changes = append(changes, presenceChange{Name: name, Inlab: true, At: first})
+		}
+	}
+	for name := range c.firstSeen {
+		if seen[name] {
+			continue
+		}
+		if !c.present[name] {
+			// disappeared before debounce
+			delete(c.firstSeen, name)
+			continue
+		}
+		last := c.lastSeen[name]
+		if now.Sub(last) >= c.grace {
+			delete(c.present, name)
+			delete(c.firstSeen, name)
+			changes = append(changes, presenceChange{Name: name, Inlab: false, At: last})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].At.Before(changes[j].At)
+	})
+	return changes
+}
+
+// readNetwork reads the file or the output of command which is configured.
+func (l *labbot) readNetwork() ([]byte, error) {
+	if l.NetworkCommand != "" {
+		out, err := exec.Command("sh", "-c", l.NetworkCommand).Output()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to run %s", l.NetworkCommand)
+		}
+		return out, nil
+	}
+	buf, err := ioutil.ReadFile(l.NetworkFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read %s", l.NetworkFile)
+	}
+	return buf, nil
+}
+
+// seenMembers returns the names of members whose registered devices are on the network.
+func (l *labbot) seenMembers(now time.Time) (map[string]bool, error) {
+	buf, err := l.readNetwork()
+	if err != nil {
+		return nil, err
+	}
+	var macs []string
+	switch l.NetworkFormat {
+	case "dnsmasq":
+		macs, err = parseDnsmasqLeases(bytes.NewReader(buf), now)
+	default:
+		macs, err = parseARP(bytes.NewReader(buf))
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse network data")
+	}
+	devices, err := l.Redis.HGetAll(macKey).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get registered devices")
+	}
+	seen := make(map[string]bool)
+	for _, mac := range macs {
+		if name, ok := devices[mac]; ok {
+			seen[name] = true
+		}
+	}
+	return seen, nil
+}
+
+// collectNetwork polls the network periodically, and records presence changes.
+func (l *labbot) collectNetwork() {
+	l.Info(
+		"start network presence collector",
+		zap.String("file", l.NetworkFile),
+		zap.String("command", l.NetworkCommand),
+		zap.String("format", l.NetworkFormat),
+	)
+	collector := newNetworkCollector(l.NetworkDebounce, l.NetworkGrace)
+	ticker := time.NewTicker(l.NetworkInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		seen, err := l.seenMembers(now)
+		if err != nil {
+			l.Warn("Failed to collect network presence", zap.Error(err))
+			continue
+		}
+		for _, change := range collector.observe(seen, now) {
+			// The lab may already know it from other sources.
+			if isAlready(change.Name) == change.Inlab {
+				continue
+			}
+			// Every instance sees the same network, only the leader posts it
+			if !l.isLeader() {
+				continue
+			}
+			l.recordPresence(change.Name, change.Inlab, change.At, sourceNetwork)
+		}
+	}
+}
+
+// registerDevice registers MAC address of the chat user's device.
+func (l *labbot) registerDevice(userID, addr string) string {
+	locale := l.localeOfChatUser(userID) // locale.go
+	mac, err := net.ParseMAC(addr)
+	if err != nil {
+		return l.messageIn(locale, "mac.invalid", &messageData{Value: addr})
+	}
+	name, err := l.memberName(userID)
+	if err != nil {
+		l.Error("Could not find member name", zap.Error(err))
+		return l.messageIn(locale, "member.unknown", &messageData{})
+	}
+	if err := l.Redis.HSet(macKey, mac.String(), name).Err(); err != nil {
+		l.Error("Could not set device to redis", zap.Error(err))
+		return l.messageIn(locale, "mac.failed", &messageData{})
+	}
+	return l.messageIn(locale, "mac.registered", &messageData{Name: name, Value: mac.String()})
+}
@@ -0,0 +1,84 @@
+package labbot
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseARP(t *testing.T) {
+	f, err := os.Open("testdata/arp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	got, err := parseARP(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// incomplete, zero and invalid entries are skipped, and addresses are normalized
+	want := []string{"aa:bb:cc:dd:ee:ff", "aa:bb:cc:00:11:22"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseARP() = %v, want %v", got, want)
+	}
+}
+
+func TestParseDnsmasqLeases(t *testing.T) {
+	f, err := os.Open("testdata/dnsmasq.leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	got, err := parseDnsmasqLeases(f, time.Unix(1508312345, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the expired lease, the duid line and the invalid address are skipped
+	want := []string{"aa:bb:cc:dd:ee:ff", "aa:bb:cc:00:11:22"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseDnsmasqLeases() = %v, want %v", got, want)
+	}
+}
+
+func TestNetworkCollector(t *testing.T) {
+	t0 := time.Date(2017, 10, 18, 9, 0, 0, 0, time.Local)
+	at := func(minutes int) time.Time {
+		return t0.Add(time.Duration(minutes) * time.Minute)
+	}
+	steps := []struct {
+		minutes int
+		seen    []string
+		want    []presenceChange
+	}{
+		{0, []string{"alice", "bob"}, nil},
+		// bob disappears before debounce, so he starts over
+		{1, []string{"alice"}, nil},
+		{2, []string{"alice", "bob"}, []presenceChange{{Name: "alice", Inlab: true, At: at(0)}}},
+		// short disconnection is ignored within grace
+		{3, []string{"bob"}, nil},
+		{4, []string{"alice", "bob"}, []presenceChange{{Name: "bob", Inlab: true, At: at(2)}}},
+		{18, []string{"bob"}, nil},
+		{19, []string{"bob"}, []presenceChange{{Name: "alice", Inlab: false, At: at(4)}}},
+		// alice comes back, and must be seen for debounce again
+		{20, []string{"alice", "bob"}, nil},
+		{22, []string{"alice", "bob"}, []presenceChange{{Name: "alice", Inlab: true, At: at(20)}}},
+	}
+
+	c := newNetworkCollector(2*time.Minute, 15*time.Minute)
+	for _, step := range steps {
+		seen := make(map[string]bool)
+		for _, name := range step.seen {
+			seen[name] = true
+		}
+		got := c.observe(seen, at(step.minutes))
+		if len(got) == 0 && len(step.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("observe() at %dm = %v, want %v", step.minutes, got, step.want)
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	flags "github.com/jessevdk/go-flags"
 	"github.com/pkg/errors"
@@ -15,29 +17,221 @@ type Options struct {
 	Version    bool `short:"v" long:"version"`
 	Port       int  `short:"p" long:"port" default:"8080"`
 	StackTrace bool `long:"trace"`
+
+	Admins          []string `long:"admin" env:"LABBOT_ADMINS" env-delim:","`
+	ApproveBackdate bool     `long:"approve-backdate"`
+	JobAlert        int      `long:"job-alert" default:"3"`
+
+	CatchUp       map[string]string `long:"catch-up"`
+	CatchUpWindow time.Duration     `long:"catch-up-window" default:"3h"`
+
+	NetworkFile     string        `long:"network-file"`
+	NetworkCommand  string        `long:"network-command"`
+	NetworkFormat   string        `long:"network-format" default:"arp" choice:"arp" choice:"dnsmasq"`
+	NetworkInterval time.Duration `long:"network-interval" default:"1m"`
+	NetworkDebounce time.Duration `long:"network-debounce" default:"2m"`
+	NetworkGrace    time.Duration `long:"network-grace" default:"15m"`
+
+	Persona    string   `long:"persona"`
+	Presenters []string `long:"presenter"`
+	Locale     string   `long:"locale" default:"ja" choice:"ja" choice:"en"`
+
+	NotifyExpiry time.Duration `long:"notify-expiry" default:"24h"`
+
+	Checklist      []string      `long:"checklist" default:"鍵" default:"エアコン" default:"電気" default:"窓"`
+	LastOutChannel string        `long:"last-out-channel"`
+	LastOutTimeout time.Duration `long:"last-out-timeout" default:"10m"`
+
+	Rooms       map[string]string `long:"room"`
+	DefaultRoom string            `long:"default-room" default:"研究室"`
+
+	LineAnnounce   []string      `long:"line-announce" env:"LABBOT_LINE_ANNOUNCE" env-delim:","`
+	ProfileRefresh time.Duration `long:"profile-refresh" default:"24h"`
+	RichMenu       string        `long:"richmenu"`
+	LineTimeout    time.Duration `long:"line-timeout" default:"10s"`
+	LineRetry      int           `long:"line-retry" default:"3"`
+
+	ChatPlatform string `long:"chat" default:"slack" choice:"slack" choice:"mattermost"`
+	PublicURL    string `long:"public-url" env:"LABBOT_URL"`
+
+	RedisAddr string `long:"redis" env:"LABBOT_REDIS" default:"127.0.0.1:6379"`
+	SlackAPI  string `long:"slack-api" env:"LABBOT_SLACK_API"`
+	LineAPI   string `long:"line-api" env:"LABBOT_LINE_API"`
+	DryRun    bool   `long:"dry-run"`
+
+	LeaderLease     time.Duration `long:"leader-lease"`
+	ShutdownTimeout time.Duration `long:"shutdown-timeout" default:"30s"`
+
+	// Subcommands, names are suffixed so as not to conflict with methods of labbot
+	ServeCommand    struct{}        `command:"serve"`
+	SimulateCommand SimulateOptions `command:"simulate"`
+	SendCommand     SendOptions     `command:"send"`
+	CronCommand     CronOptions     `command:"cron"`
+	PresenceCommand PresenceOptions `command:"presence"`
+	ExportCommand   ExportOptions   `command:"export"`
+
+	// command is the name of subcommand like "cron next", empty for running the server
+	command string
+}
+
+// SendOptions is options for "labbot send"
+type SendOptions struct {
+	Channel string `long:"channel" default:"general"`
+	Text    string `long:"text" required:"true"`
+	LINE    bool   `long:"line"`
+}
+
+// CronOptions is options for "labbot cron list|next"
+type CronOptions struct {
+	List struct{} `command:"list"`
+	Next struct {
+		Count int `long:"count" default:"5"`
+	} `command:"next"`
+}
+
+// PresenceOptions is options for "labbot presence show|reset"
+type PresenceOptions struct {
+	Show  struct{} `command:"show"`
+	Reset struct {
+		All bool `long:"all"`
+	} `command:"reset"`
+}
+
+// ExportOptions is options for "labbot export attendance"
+type ExportOptions struct {
+	Attendance struct {
+		Since  string `long:"since"`
+		Until  string `long:"until"`
+		Output string `long:"output" short:"o"`
+	} `command:"attendance"`
+}
+
+// SimulateOptions is options for "labbot simulate"
+type SimulateOptions struct {
+	URL      string        `long:"url" default:"http://localhost:8080/line"`
+	User     string        `long:"user"`
+	HWID     string        `long:"hwid"`
+	Type     string        `long:"type" default:"enter" choice:"enter" choice:"leave"`
+	At       string        `long:"at"`
+	Scenario string        `long:"scenario"`
+	Speed    float64       `long:"speed" default:"0"`
+	Timeout  time.Duration `long:"timeout" default:"10s"`
 }
 
 func (opts *Options) parse(argv []string) ([]string, error) {
 	p := flags.NewParser(opts, flags.PrintErrors)
+	p.SubcommandsOptional = true
 	args, err := p.ParseArgs(argv)
 	if err != nil {
 		os.Stderr.Write(opts.usage())
 		return nil, errors.Wrap(err, "invalid command line options")
 	}
+	names := []string{}
+	for c := p.Active; c != nil; c = c.Active {
+		names = append(names, c.Name)
+	}
+	opts.command = strings.Join(names, " ")
 
 	return args, nil
 }
 
+// validate checks options which flags cannot, so that the server doesn't fail after start.
+func (opts *Options) validate() error {
+	if opts.NetworkInterval <= 0 {
+		return errors.Errorf("--network-interval must be positive, but %s", opts.NetworkInterval)
+	}
+	for name, policy := range opts.CatchUp {
+		if !isCronJob(name) { // cron.go
+			return errors.Errorf("--catch-up has unknown job %q", name)
+		}
+		if policy != catchUpRun && policy != catchUpSkip { // catchup.go
+			return errors.Errorf("--catch-up policy of %s must be %q or %q, but %q", name, catchUpRun, catchUpSkip, policy)
+		}
+	}
+	return nil
+}
+
 func (opts Options) usage() []byte {
 	buf := bytes.Buffer{}
 
 	fmt.Fprintf(&buf, msg+
-		`Usage: labbot [options]
+		`Usage: labbot [options] [command]
+  Commands:
+  serve                      run the server (default)
+  send --text <text>         post the announcement to the chat channel
+  cron list                  show scheduled jobs and the next time of them
+  cron next                  show upcoming job times
+  presence show              show who is in the lab
+  presence reset [name...]   remove the presence of members, --all removes everyone
+  export attendance          write the attendance history as CSV
+  simulate                   post signed LINE beacon events to running labbot
   Options:
   -h,  --help                print usage and exit
   -v,  --version             display the version of labbot and exit
   -p,  --port <num>          port number to run server
   --trace                    display detail error messages
+  --admin <name>             slack user name of administrator (env: LABBOT_ADMINS)
+  --approve-backdate         backdated check-in/out requires approval of administrators
+  --job-alert <num>          send DM to administrators when a cron job fails N times in a row,
+                             0 disables (default: 3)
+  --catch-up <job:policy>    policy for the job run missed during downtime, "run" or "skip"
+                             (e.g. progress:run), jobs are shown by "cron list"
+  --catch-up-window <dur>    runs missed within the duration are caught up on startup,
+                             0 disables (default: 3h)
+  --network-file <path>      file to detect devices on the network (e.g. /proc/net/arp)
+  --network-command <cmd>    command whose output is used instead of --network-file
+  --network-format <format>  format of network data, "arp" or "dnsmasq" (default: arp)
+  --network-interval <dur>   interval to poll the network (default: 1m)
+  --network-debounce <dur>   duration devices must be seen before entering (default: 2m)
+  --network-grace <dur>      duration devices must be missing before leaving (default: 15m)
+  --persona <path>           json file of the bot name and message templates (default: chihiro)
+  --presenter <name>         presenter of the seminar in weekly turn, {{.Presenter}} in templates
+  --locale <locale>          language of messages to channels, "ja" or "en" (default: ja),
+                             members can choose their own by "lang en" or "English" on LINE
+  --notify-expiry <dur>      expiry of "notify me when @x arrives" without duration (default: 24h)
+  --checklist <item>         checklist for the last person who leaves the lab, --checklist ""
+                             disables it (default: 鍵, エアコン, 電気, 窓)
+  --last-out-channel <name>  chat channel to tell when the checklist is not acknowledged
+  --last-out-timeout <dur>   duration to wait for the acknowledgment of the checklist,
+                             it's checked every minute (default: 10m)
+  --room <hwid:name>         name of the room where the beacon is put (e.g. 0123456789:実験室)
+  --default-room <name>      name of the room for unknown beacons and other sources (default: 研究室)
+  --line-announce <job>      also send the announcement to LINE, "progress", "seminar",
+                             "day-after-tomorrow" or "clean" (env: LABBOT_LINE_ANNOUNCE)
+  --profile-refresh <dur>    duration to cache LINE profiles of members (default: 24h)
+  --richmenu <path>          json file of LINE rich menu layout which the leader registers
+  --line-timeout <dur>       timeout of LINE API calls including retries (default: 10s)
+  --line-retry <num>         number of retries when LINE responds 429 or 5xx (default: 3)
+  --chat <platform>          chat platform, "slack" or "mattermost" (default: slack)
+  --public-url <url>         url of this server which chat platform can reach (env: LABBOT_URL)
+  --redis <addr>             address of redis server (env: LABBOT_REDIS, default: 127.0.0.1:6379)
+  --slack-api <url>          base url of slack web api, e.g. fake server (env: LABBOT_SLACK_API)
+  --line-api <url>           base url of LINE messaging api, e.g. fake server (env: LABBOT_LINE_API)
+  --dry-run                  log messages to chat and LINE instead of sending them
+  --leader-lease <dur>       elect the leader by redis lock for multiple instances, only the leader
+                             runs cron jobs and replies to mentions (e.g. 15s, default: disabled)
+  --shutdown-timeout <dur>   deadline to wait in-flight work on shutdown (default: 30s)
+  Send options:
+  --channel <name>           name of the chat channel (default: general)
+  --text <text>              text of the announcement
+  --line                     also send the announcement to LINE followers
+  Cron next options:
+  --count <num>              number of upcoming job times (default: 5)
+  Presence reset options:
+  --all                      remove the presence of everyone
+  Export attendance options:
+  --since <date>             first day to export, "2006-01-02" (default: the first day of this month)
+  --until <date>             last day to export, "2006-01-02" (default: today)
+  -o,  --output <path>       file to write CSV (default: stdout)
+  Simulate options: (needs CHANNEL_SECRET)
+  --url <url>                url of LINE webhook (default: http://localhost:8080/line)
+  --user <id>                LINE user id of the member
+  --hwid <hwid>              hardware id of the beacon
+  --type <type>              "enter" or "leave" (default: enter)
+  --at <time>                fake time of the event, "15:04" or "2006-01-02 15:04" (default: now)
+  --scenario <path>          file of events to replay, each line is "15:04 <user> <hwid> enter|leave"
+  --speed <num>              replay the scenario N times faster than real time, 0 is no wait (default: 0)
+  --timeout <dur>            timeout of each request (default: 10s)
 `)
 	return buf.Bytes()
 }
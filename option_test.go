@@ -0,0 +1,29 @@
+package labbot
+
+import "testing"
+
+func TestOptionsValidateCatchUp(t *testing.T) {
+	tests := []struct {
+		args  []string
+		valid bool
+	}{
+		{nil, true},
+		{[]string{"--catch-up", "progress:run", "--catch-up", "seminar:skip"}, true},
+		{[]string{"--catch-up", "progres:run"}, false},
+		{[]string{"--catch-up", "progress:later"}, false},
+		{[]string{"--catch-up", "progress:"}, false},
+	}
+	for _, tt := range tests {
+		var opts Options
+		if _, err := opts.parse(tt.args); err != nil {
+			t.Fatalf("parse(%q) = %v", tt.args, err)
+		}
+		err := opts.validate()
+		if tt.valid && err != nil {
+			t.Errorf("validate(%q) = %v", tt.args, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("validate(%q) should fail", tt.args)
+		}
+	}
+}
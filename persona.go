@@ -0,0 +1,425 @@
+package labbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// persona is the name and the voice of the bot which is loaded from --persona.
+// Each message is variants of text/template with messageData, and one of them
+// is chosen at random in proportion to the weight (default: 1).
+// Messages which are not in the file fall back to chihiro's.
+// Messages in the other locales than Japanese are in "locales", see locale.go
+//
+//	{
+//	  "name": "chihiro",
+//	  "nicknames": {"ja": "千尋", "en": "Chihiro"},
+//	  "messages": {
+//	    "clean": [
+//	      {"text": "<!channel> 掃除しましょう! 今{{.PeopleInLab}}人いますよ!", "weight": 3},
+//	      {"text": "<!channel> たまには机の上も拭きましょうねっ!"}
+//	    ]
+//	  },
+//	  "locales": {
+//	    "en": {
+//	      "clean": [{"text": "<!channel> Let's clean the lab!"}]
+//	    }
+//	  }
+//	}
+type persona struct {
+	Name string `json:"name"`
+	// Nicknames are names by which the bot calls itself in each locale
+	Nicknames map[string]string               `json:"nicknames"`
+	Messages  map[string][]variant            `json:"messages"`
+	Locales   map[string]map[string][]variant `json:"locales"`
+
+	// templates are parsed messages by locale and id
+	templates map[string]map[string][]*weightedTemplate
+}
+
+type variant struct {
+	Text   string `json:"text"`
+	Weight int    `json:"weight"`
+}
+
+type weightedTemplate struct {
+	*template.Template
+	weight int
+}
+
+// messageData is the variables of message templates
+type messageData struct {
+	Name        string // name of the member
+	Room        string // room where the member is
+	From        string // room which the member moved from
+	Time        string // time of the event in tmformat
+	Hours       int    // hours in the lab
+	Minutes     int    // minutes in the lab, which is less than an hour
+	Names       string // names of members in the room
+	Value       string // other value in the message, e.g. the MAC address or the error
+	Count       int    // number of times, e.g. consecutive failures of the job
+	Presenter   string // presenter of the seminar this week, see --presenter
+	PeopleInLab int    // number of people in the lab
+	Bot         string // nickname of the bot in the locale
+}
+
+// defaultMessages is the voice of chihiro
+var defaultMessages = map[string][]variant{
+	// cron.go
+	"progress":           {{Text: "<!here> みなさん、進捗どうですか!?"}},
+	"seminar":            {{Text: "<!channel> みなさん、今日はｾﾞﾐの日ですよ!\n私も応援してますからね!"}},
+	"day-after-tomorrow": {{Text: "<!channel> 明後日はｾﾞﾐの日ですよ!"}},
+	"clean": {
+		{Text: "<!channel> みなさんっ！掃除はしてますか？\n机の上にあるｺﾞﾐはｺﾞﾐ箱に入れましょう!"},
+		{Text: "<!channel> みなさんっ！掃除はしてますか？\nたまには掃除機を使って床を掃除してあげてくださいっ!"},
+		{Text: "<!channel> みなさんっ！掃除はしてますか？\nｾﾞﾐの後は綺麗な空間でゆっくり休んで欲しいです。"},
+		{Text: "<!channel> みなさんっ！掃除はしてますか？\nたまには机の上も拭きましょうねっ!"},
+	},
+
+	// line-beacon.go
+	"enter.morning":  {{Text: "{{.Name}}さんおはようございます♡"}},
+	"enter.daytime":  {{Text: "{{.Name}}さんこんにちは♡"}},
+	"enter.night":    {{Text: "{{.Name}}さんこんばんは♡"}},
+	"enter.midnight": {{Text: "{{.Name}}さん遅くまでお疲れ様です♡"}},
+	"leave.short":    {{Text: "{{.Name}}さん、お疲れ様です！"}},
+	"leave.long":     {{Text: "{{.Name}}さん、とっても頑張ったんですね…。尊敬します！"}},
+	"leave.overwork": {{Text: "{{.Name}}さん、死なないでくださいね！"}},
+	"welcome":        {{Text: "{{.Name}}さんが{{.Time}}に{{.Room}}へ来ました♡"}},
+	"seeyou":         {{Text: "{{.Name}}さんが{{.Time}}に{{.Room}}から帰りました♡"}},
+	"move":           {{Text: "{{.Name}}さんが{{.Time}}に{{.From}}から{{.Room}}へ移動しました♡"}},
+
+	// chat.go
+	"choice.join":     {{Text: "参加する"}},
+	"choice.not-join": {{Text: "参加しない"}},
+	"choice.approve":  {{Text: "承認する"}},
+	"choice.reject":   {{Text: "却下する"}},
+	"reply.join":      {{Text: "楽しんでくださいねっ！"}},
+	"reply.not-join":  {{Text: "残念です…"}},
+	"usage.iam":       {{Text: "LINEでの名前を教えてくださいね (例: iam 千尋)"}},
+	"usage.pin":       {{Text: "PINはDMでこっそり教えてくださいね (例: pin 1234)"}},
+	"usage.qr":        {{Text: "QRコードのトークンはDMで聞いてくださいね"}},
+	"usage.mac":       {{Text: "端末のMACアドレスを教えてくださいね (例: mac aa:bb:cc:dd:ee:ff)"}},
+	"usage.command":   {{Text: "使い方: /labbot in [--at 09:30], /labbot out [--at 18:00], /labbot pin 1234, /labbot qr, /labbot mac aa:bb:cc:dd:ee:ff"}},
+
+	// commands.go
+	"people.room":      {{Text: "{{.Room}}には{{.Names}}がいます！"}},
+	"people.nobody":    {{Text: "今は誰もいないみたいです…"}},
+	"week":             {{Text: "{{.Name}}さんは今週{{.Hours}}時間{{.Minutes}}分研究室にいました！"}},
+	"seminar.next":     {{Text: "次のｾﾞﾐは{{.Time}}ですよ!"}},
+	"seminar.failed":   {{Text: "ごめんなさい、ｾﾞﾐの予定がわかりませんでした…"}},
+	"usage.whoisthere": {{Text: "「誰がいる?」"}},
+	"usage.week":       {{Text: "「今週の時間」"}},
+	"usage.seminar":    {{Text: "「ゼミいつ?」"}},
+
+	// checkin.go
+	"member.unknown":          {{Text: "ごめんなさい、どなたかわかりませんでした…"}},
+	"link.done":               {{Text: "{{.Name}}さんですね！覚えました♡"}},
+	"link.failed":             {{Text: "ごめんなさい、覚えられませんでした…"}},
+	"link.requested":          {{Text: "{{.Name}}さんは別のアカウントと連携しているので、管理者に確認をお願いしました！少し待っててくださいね"}},
+	"link.request":            {{Text: "{{.Value}}さんが{{.Name}}さんとして連携しようとしています。{{.Name}}さんは別のアカウントと連携しています"}},
+	"link.rejected":           {{Text: "{{.Name}}さんとしての連携は却下されました…"}},
+	"check.usage":             {{Text: "in か out を指定してくださいね"}},
+	"check.unknown":           {{Text: "{{.Value}} はわかりません…。in か out を指定してくださいね"}},
+	"check.unknown-option":    {{Text: "{{.Value}} はわかりません…"}},
+	"check.no-time":           {{Text: "--at には時刻を指定してください (例: --at 09:30)"}},
+	"check.invalid-time":      {{Text: "{{.Value}} は時刻として読めません (例: --at 09:30)"}},
+	"check.before-last":       {{Text: "{{.Value}} は前回の記録より前です…"}},
+	"check.already-in":        {{Text: "{{.Name}}さんはもう研究室にいますよ？"}},
+	"check.not-in":            {{Text: "{{.Name}}さんはまだ研究室に来ていませんよ？"}},
+	"check.failed":            {{Text: "ごめんなさい、記録できませんでした…"}},
+	"approval.in":             {{Text: "{{.Name}}さんが{{.Time}}に来たと申請しています"}},
+	"approval.out":            {{Text: "{{.Name}}さんが{{.Time}}に帰ったと申請しています"}},
+	"approval.requested":      {{Text: "管理者に承認をお願いしました！少し待っててくださいね"}},
+	"approval.request-failed": {{Text: "ごめんなさい、管理者にお願いできませんでした…"}},
+	"approval.admin-only":     {{Text: "承認できるのは管理者だけです"}},
+	"approval.handled":        {{Text: "この申請はもう処理されています"}},
+	"approval.failed":         {{Text: "申請を読み込めませんでした…"}},
+	"approval.approve":        {{Text: "承認しました"}},
+	"approval.reject":         {{Text: "却下しました"}},
+	"approval.approved":       {{Text: "{{.Time}}の申請が承認されました！"}},
+	"approval.rejected":       {{Text: "{{.Time}}の申請は却下されました…"}},
+
+	// line.go
+	"help":           {{Text: "ごめんなさい、わかりませんでした…\n{{.Names}}って聞いてくださいね♡"}},
+	"greet.group":    {{Text: "{{.Bot}}です！よろしくお願いします♡\nお知らせを受け取りたい人は、私を友だちに追加してくださいね"}},
+	"optout.done":    {{Text: "お知らせを送らないようにしました。また聞きたくなったら「通知オン」って言ってくださいね"}},
+	"optin.done":     {{Text: "お知らせを送るようにしました♡"}},
+	"optout.failed":  {{Text: "ごめんなさい、設定できませんでした…"}},
+	"usage.opt-out":  {{Text: "「通知オフ」"}},
+	"usage.opt-in":   {{Text: "「通知オン」"}},
+	"usage.checkin":  {{Text: "「チェックイン」"}},
+	"usage.checkout": {{Text: "「チェックアウト」"}},
+	"usage.english":  {{Text: "「English」"}},
+	"usage.japanese": {{Text: "「日本語」"}},
+
+	// kiosk.go
+	"pin.short":         {{Text: "PINは4桁以上にしてくださいね"}},
+	"pin.set":           {{Text: "{{.Name}}さんのPINを登録しました♡"}},
+	"pin.failed":        {{Text: "ごめんなさい、PINを登録できませんでした…"}},
+	"pin.locked":        {{Text: "PINを何度も間違えたので、しばらく使えません"}},
+	"pin.not-set":       {{Text: "PINが登録されていません"}},
+	"pin.wrong":         {{Text: "PINが違います"}},
+	"qr.unavailable":    {{Text: "QRコードは使えません"}},
+	"qr.disabled":       {{Text: "QRコードは使えない設定になっています…"}},
+	"qr.unreadable":     {{Text: "QRコードが読めません"}},
+	"qr.invalid":        {{Text: "QRコードが正しくありません"}},
+	"qr.expired":        {{Text: "QRコードの期限が切れています"}},
+	"qr.revoked":        {{Text: "このQRコードはもう使えません"}},
+	"qr.token":          {{Text: "{{.Name}}さんのQRコード用のトークンです♡ 前のトークンは使えなくなりました\n```{{.Value}}```"}},
+	"qr.failed":         {{Text: "ごめんなさい、トークンを発行できませんでした…"}},
+	"kiosk.bad-request": {{Text: "リクエストが読めません"}},
+	"kiosk.bad-action":  {{Text: "action は in, out, toggle のどれかです"}},
+	"kiosk.failed":      {{Text: "ごめんなさい、確認できませんでした…"}},
+
+	// network.go
+	"mac.invalid":    {{Text: "{{.Value}} はMACアドレスとして読めません…"}},
+	"mac.registered": {{Text: "{{.Name}}さんの端末 {{.Value}} を登録しました♡"}},
+	"mac.failed":     {{Text: "ごめんなさい、登録できませんでした…"}},
+
+	// members.go
+	"members.member":       {{Text: "{{.Name}} `{{.Value}}` {{.Time}}から"}},
+	"members.blocked":      {{Text: "{{.Name}} `{{.Value}}` {{.Time}}から (ブロック中)"}},
+	"members.unknown-time": {{Text: "不明"}},
+	"members.empty":        {{Text: "まだ誰も登録されていません…"}},
+	"members.admin-only":   {{Text: "ごめんなさい、メンバー一覧は管理者にしか見せられません…"}},
+	"members.failed":       {{Text: "ごめんなさい、メンバーを読み込めませんでした…"}},
+
+	// history.go
+	"source.beacon":  {{Text: "LINE Beacon"}},
+	"source.manual":  {{Text: "手動"}},
+	"source.kiosk":   {{Text: "キオスク"}},
+	"source.network": {{Text: "ネットワーク"}},
+	"source.line":    {{Text: "LINEメニュー"}},
+
+	// jobs.go
+	"jobs.job":          {{Text: "`{{.Name}}` 次回 {{.Time}} / {{.Value}}"}},
+	"jobs.never":        {{Text: "まだ実行していません"}},
+	"jobs.last-success": {{Text: "前回 {{.Time}} 成功"}},
+	"jobs.last-skipped": {{Text: "前回 {{.Time}} スキップ"}},
+	"jobs.last-failure": {{Text: "前回 {{.Time}} 失敗 ({{.Count}}回連続: {{.Value}})"}},
+	"jobs.failed":       {{Text: "ごめんなさい、お仕事の記録を読み込めませんでした…"}},
+	"jobs.alert":        {{Text: "{{.Name}}のお仕事が{{.Count}}回続けて失敗しちゃいました…確認してもらえますか？\n{{.Value}}"}},
+
+	// timequery.go
+	"history.who-at":         {{Text: "{{.Time}}には{{.Names}}がいました！"}},
+	"history.nobody-at":      {{Text: "{{.Time}}には誰もいなかったみたいです…"}},
+	"history.who-on":         {{Text: "{{.Time}}には{{.Names}}が来ていました！"}},
+	"history.nobody-on":      {{Text: "{{.Time}}は誰も来ていなかったみたいです…"}},
+	"history.came":           {{Text: "{{.Name}}さんは{{.Time}}に来ました！"}},
+	"history.left":           {{Text: "{{.Name}}さんは{{.Time}}に帰りました！"}},
+	"history.not-came":       {{Text: "{{.Name}}さんは{{.Time}}には来ていないみたいです…"}},
+	"history.not-left":       {{Text: "{{.Name}}さんは{{.Time}}には帰っていないみたいです…"}},
+	"history.unknown-member": {{Text: "ごめんなさい、どなたのことかわかりませんでした…"}},
+	"history.failed":         {{Text: "ごめんなさい、記録を読めませんでした…"}},
+
+	// subscription.go
+	"notify.once":      {{Text: "{{if .Name}}{{.Name}}さんが{{else}}誰か{{end}}来たらお知らせしますね♡ ({{.Time}}まで)"}},
+	"notify.every":     {{Text: "{{.Time}}まで、{{if .Name}}{{.Name}}さんが{{else}}誰かが{{end}}来るたびにお知らせしますね♡"}},
+	"notify.arrived":   {{Text: "{{.Name}}さんが{{.Time}}に{{.Room}}へ来ましたよ♡"}},
+	"notify.cancelled": {{Text: "お知らせをやめました"}},
+	"notify.failed":    {{Text: "ごめんなさい、覚えられませんでした…"}},
+
+	// lastout.go
+	"lastout.title":     {{Text: "戸締まり確認"}},
+	"lastout.checklist": {{Text: "{{.Name}}さんが最後ですね！\n{{.Names}}の確認をお願いします♡"}},
+	"choice.lastout":    {{Text: "確認しました"}},
+	"lastout.acked":     {{Text: "ありがとうございます！気をつけて帰ってくださいね♡"}},
+	"lastout.expired":   {{Text: "もう確認済みか、時間切れになっています…"}},
+	"lastout.escalated": {{Text: "<!channel> {{.Name}}さんが{{.Time}}に最後に帰りましたが、{{.Names}}の確認がまだみたいです…どなたか確認してもらえますか？"}},
+
+	// locale.go
+	"locale.set":       {{Text: "日本語でお話ししますね♡"}},
+	"locale.usage":     {{Text: "「lang ja」か「lang en」で教えてくださいね"}},
+	"locale.no-member": {{Text: "ごめんなさい、LINEの友だちに見つかりませんでした…「iam LINEでの名前」で教えてくださいね"}},
+	"locale.failed":    {{Text: "ごめんなさい、設定できませんでした…"}},
+}
+
+// loadPersona reads the persona from path, or returns chihiro if path is empty.
+func loadPersona(path string) (*persona, error) {
+	p := &persona{Name: botName}
+	if path == "" {
+		p.Nicknames = map[string]string{localeJa: "千尋", localeEn: "Chihiro"}
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to open persona")
+		}
+		defer f.Close()
+		if err := json.NewDecoder(f).Decode(p); err != nil {
+			return nil, errors.Wrap(err, "Failed to decode persona")
+		}
+	}
+	p.Messages = mergeMessages(p.Messages, defaultMessages)
+	if p.Locales == nil {
+		p.Locales = make(map[string]map[string][]variant)
+	}
+	for locale, catalog := range catalogs { // locale.go
+		p.Locales[locale] = mergeMessages(p.Locales[locale], catalog)
+	}
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// mergeMessages fills messages which are not in the persona with defaults.
+func mergeMessages(messages, defaults map[string][]variant) map[string][]variant {
+	if messages == nil {
+		messages = make(map[string][]variant, len(defaults))
+	}
+	for id, variants := range defaults {
+		if _, ok := messages[id]; !ok {
+			messages[id] = variants
+		}
+	}
+	return messages
+}
+
+// parse compiles templates of all locales.
+func (p *persona) parse() error {
+	p.templates = make(map[string]map[string][]*weightedTemplate, len(p.Locales)+1)
+	templates, err := parseMessages(p.Messages)
+	if err != nil {
+		return err
+	}
+	p.templates[localeJa] = templates
+	for locale, messages := range p.Locales {
+		if !isLocale(locale) {
+			return errors.Errorf("unknown locale %s", locale)
+		}
+		templates, err := parseMessages(messages)
+		if err != nil {
+			return errors.Wrapf(err, "locale %s", locale)
+		}
+		p.templates[locale] = templates
+	}
+	return nil
+}
+
+// parseMessages compiles templates, and executes them once so that
+// unknown variables are reported on startup.
+func parseMessages(messages map[string][]variant) (map[string][]*weightedTemplate, error) {
+	parsed := make(map[string][]*weightedTemplate, len(messages))
+	for id, variants := range messages {
+		if len(variants) == 0 {
+			return nil, errors.Errorf("message %s has no variants", id)
+		}
+		templates := make([]*weightedTemplate, 0, len(variants))
+		for i, v := range variants {
+			t, err := template.New(fmt.Sprintf("%s[%d]", id, i)).Parse(v.Text)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid template of %s", id)
+			}
+			if err := t.Execute(new(bytes.Buffer), &messageData{}); err != nil {
+				return nil, errors.Wrapf(err, "Invalid template of %s", id)
+			}
+			weight := v.Weight
+			if weight <= 0 {
+				weight = 1
+			}
+			templates = append(templates, &weightedTemplate{Template: t, weight: weight})
+		}
+		parsed[id] = templates
+	}
+	return parsed, nil
+}
+
+// render executes one of variants of the message in the locale.
+// The message falls back to Japanese if the locale doesn't have it.
+func (p *persona) render(locale, id string, data *messageData) (string, error) {
+	templates, ok := p.templates[locale][id]
+	if !ok {
+		templates, ok = p.templates[localeJa][id]
+	}
+	if !ok {
+		return "", errors.Errorf("unknown message %s", id)
+	}
+	total := 0
+	for _, t := range templates {
+		total += t.weight
+	}
+	n := rand.Intn(total)
+	chosen := templates[len(templates)-1]
+	for _, t := range templates {
+		if n < t.weight {
+			chosen = t
+			break
+		}
+		n -= t.weight
+	}
+	buf := bytes.Buffer{}
+	if err := chosen.Execute(&buf, data); err != nil {
+		return "", errors.Wrapf(err, "Failed to execute template of %s", id)
+	}
+	return buf.String(), nil
+}
+
+// nickname returns the nickname in the locale, which falls back to Japanese and the name.
+func (p *persona) nickname(locale string) string {
+	if nickname, ok := p.Nicknames[locale]; ok {
+		return nickname
+	}
+	if nickname, ok := p.Nicknames[localeJa]; ok {
+		return nickname
+	}
+	return p.Name
+}
+
+// message returns the message of the persona in --locale, which is used for channels.
+func (l *labbot) message(id string, data *messageData) string {
+	return l.messageIn(l.Locale, id, data)
+}
+
+// messageIn returns the message of the persona in the locale. PeopleInLab and Bot are filled here.
+func (l *labbot) messageIn(locale, id string, data *messageData) string {
+	data.PeopleInLab = countPeopleInLab() // line-beacon.go
+	data.Bot = l.persona.nickname(locale)
+	text, err := l.persona.render(locale, id, data)
+	if err != nil {
+		l.Error("Failed to render message", zap.String("id", id), zap.String("locale", locale), zap.Error(err))
+	}
+	return text
+}
+
+// messageError is the error which is shown to users as the message of id.
+type messageError struct {
+	id   string
+	data *messageData
+}
+
+func newMessageError(id string, data *messageData) error {
+	return &messageError{id: id, data: data}
+}
+
+func (e *messageError) Error() string {
+	if e.data.Value != "" {
+		return e.id + ": " + e.data.Value
+	}
+	return e.id
+}
+
+// errorMessage returns the message of err in the locale, or the message of fallback
+// if err is not messageError, e.g. an error of redis which users cannot fix.
+func (l *labbot) errorMessage(locale string, err error, fallback string) string {
+	if e, ok := err.(*messageError); ok {
+		return l.messageIn(locale, e.id, e.data)
+	}
+	return l.messageIn(locale, fallback, &messageData{})
+}
+
+// presenter returns the presenter of the week in turn of --presenter.
+func (l *labbot) presenter(now time.Time) string {
+	if len(l.Presenters) == 0 {
+		return ""
+	}
+	_, week := now.ISOWeek()
+	return l.Presenters[week%len(l.Presenters)]
+}
@@ -0,0 +1,115 @@
+package labbot
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// richMenuConfig is the layout of rich menu which is loaded from --richmenu.
+//
+//	{
+//	  "size": {"width": 2500, "height": 843},
+//	  "selected": true,
+//	  "name": "labbot",
+//	  "chatBarText": "メニュー",
+//	  "image": "public/richmenu.png",
+//	  "areas": [
+//	    {
+//	      "bounds": {"x": 0, "y": 0, "width": 833, "height": 843},
+//	      "action": {"type": "postback", "data": "action=whoisthere", "displayText": "今いる人"}
+//	    }
+//	  ]
+//	}
+type richMenuConfig struct {
+	linebot.RichMenu
+	Image string `json:"image"`
+}
+
+func loadRichMenuConfig(path string) (*richMenuConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to open rich menu config")
+	}
+	defer f.Close()
+	config := new(richMenuConfig)
+	if err := json.NewDecoder(f).Decode(config); err != nil {
+		return nil, errors.Wrap(err, "Failed to decode rich menu config")
+	}
+	return config, nil
+}
+
+// setupRichMenu creates the rich menu and sets it as default.
+// The rich menus which have the same name are replaced after the new one is the default,
+// so users keep the old menu when it fails. It's run by the leader, see leader.go
+func (l *labbot) setupRichMenu() error {
+	config, err := loadRichMenuConfig(l.RichMenu)
+	if err != nil {
+		return err
+	}
+	menus, err := l.LINE.GetRichMenuList().Do()
+	if err != nil {
+		return errors.Wrap(err, "Failed to get rich menu list")
+	}
+
+	res, err := l.LINE.CreateRichMenu(config.RichMenu).Do()
+	if err != nil {
+		return errors.Wrap(err, "Failed to create rich menu")
+	}
+	if _, err := l.LINE.UploadRichMenuImage(res.RichMenuID, config.Image).Do(); err != nil {
+		return errors.Wrap(err, "Failed to upload rich menu image")
+	}
+	if _, err := l.LINE.SetDefaultRichMenu(res.RichMenuID).Do(); err != nil {
+		return errors.Wrap(err, "Failed to set default rich menu")
+	}
+	l.Info("rich menu is created", zap.String("id", res.RichMenuID), zap.String("name", config.Name))
+
+	for _, menu := range menus {
+		if menu.Name != config.Name {
+			continue
+		}
+		if _, err := l.LINE.DeleteRichMenu(menu.RichMenuID).Do(); err != nil {
+			return errors.Wrapf(err, "Failed to delete rich menu %s", menu.RichMenuID)
+		}
+	}
+	return nil
+}
+
+// replyToPostback answers the postback like "action=whoisthere" from the rich menu.
+func (l *labbot) replyToPostback(event *linebot.Event) {
+	query, err := url.ParseQuery(event.Postback.Data)
+	if err != nil {
+		l.Warn("Invalid postback data", zap.String("data", event.Postback.Data), zap.Error(err))
+		return
+	}
+	action := query.Get("action")
+	if action == "lastout" {
+		member, err := l.member(event.Source.UserID)
+		if err != nil {
+			l.Warn("Failed to get member", zap.Error(err))
+		}
+		reply := l.ackLastOut(query.Get("id"), l.memberLocale(member)) // lastout.go
+		if _, err := l.LINE.ReplyMessage(event.ReplyToken, linebot.NewTextMessage(reply)).Do(); err != nil {
+			l.Error("Failed to reply message", zap.Error(err))
+		}
+		return
+	}
+	cmd, ok := findAction(lineCommands, action)
+	if !ok {
+		cmd, ok = findAction(commands, action)
+	}
+	if !ok {
+		l.Warn("Unknown postback action", zap.String("action", action))
+		return
+	}
+
+	reply := cmd.run(l, l.lineRequest("", event.Source.UserID))
+	_, err = l.LINE.ReplyMessage(event.ReplyToken, linebot.NewTextMessage(reply)).Do()
+	if err != nil {
+		l.Error("Failed to reply message", zap.Error(err))
+	}
+}
@@ -0,0 +1,51 @@
+package labbot
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/Code-Hex/labbot/internal/testserver"
+)
+
+func TestSetupRichMenuReplacesAfterDefault(t *testing.T) {
+	slack := testserver.NewSlack()
+	defer slack.Close()
+	line := testserver.NewLINE()
+	defer line.Close()
+	l, _ := newTestLabbot(t, slack, line)
+
+	dir := t.TempDir()
+	l.RichMenu = filepath.Join(dir, "richmenu.json")
+	image := filepath.Join(dir, "richmenu.png")
+	config := `{"size": {"width": 2500, "height": 843}, "name": "labbot", "image": "` + image + `"}`
+	if err := ioutil.WriteFile(l.RichMenu, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(image, []byte("\x89PNG"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.setupRichMenu(); err != nil {
+		t.Fatalf("setupRichMenu() = %v", err)
+	}
+	line.Reset()
+	if err := l.setupRichMenu(); err != nil {
+		t.Fatalf("setupRichMenu() = %v", err)
+	}
+
+	var order []string
+	for _, call := range line.Calls() {
+		switch {
+		case call.Method == http.MethodPost && call.Path == "/v2/bot/user/all/richmenu/richmenu-2":
+			order = append(order, "default richmenu-2")
+		case call.Method == http.MethodDelete:
+			order = append(order, "delete "+filepath.Base(call.Path))
+		}
+	}
+	// Users have the old menu until the new one is the default
+	if len(order) != 2 || order[0] != "default richmenu-2" || order[1] != "delete richmenu-1" {
+		t.Errorf("calls = %v, want the default before deleting the old menu", order)
+	}
+}
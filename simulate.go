@@ -0,0 +1,147 @@
+package labbot
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Code-Hex/exit"
+	"github.com/Code-Hex/labbot/internal/linewebhook"
+	"github.com/pkg/errors"
+)
+
+// simulatedEvent is a beacon event which is sent by "labbot simulate"
+type simulatedEvent struct {
+	At   time.Time
+	User string
+	HWID string
+	Type string
+}
+
+// run posts signed beacon events to the running labbot, so that presence
+// can be checked without a physical LINE Beacon.
+func (opts *SimulateOptions) run() error {
+	if channelSecret == "" {
+		return exit.MakeConfig(errors.New("CHANNEL_SECRET is required to sign webhooks"))
+	}
+	base, err := parseSimulatedTime(opts.At, time.Now())
+	if err != nil {
+		return exit.MakeUsage(err)
+	}
+
+	var events []*simulatedEvent
+	if opts.Scenario != "" {
+		f, err := os.Open(opts.Scenario)
+		if err != nil {
+			return exit.MakeNoInput(errors.Wrap(err, "Failed to open scenario"))
+		}
+		defer f.Close()
+		events, err = parseScenario(f, base)
+		if err != nil {
+			return exit.MakeDataErr(err)
+		}
+	} else {
+		if opts.User == "" || opts.HWID == "" {
+			return exit.MakeUsage(errors.New("--user and --hwid are required without --scenario"))
+		}
+		events = []*simulatedEvent{
+			{At: base, User: opts.User, HWID: opts.HWID, Type: opts.Type},
+		}
+	}
+
+	client := &http.Client{Timeout: opts.Timeout}
+	for i, event := range events {
+		if i > 0 && opts.Speed > 0 {
+			time.Sleep(time.Duration(float64(event.At.Sub(events[i-1].At)) / opts.Speed))
+		}
+		if err := opts.post(client, event); err != nil {
+			return exit.MakeUnAvailable(err)
+		}
+		fmt.Printf("%s %s %s %s\n", event.At.Format(tmformat), event.User, event.HWID, event.Type)
+	}
+	return nil
+}
+
+func (opts *SimulateOptions) post(client *http.Client, event *simulatedEvent) error {
+	req, err := linewebhook.NewWebhookRequest(
+		opts.URL,
+		channelSecret,
+		linewebhook.BeaconEvent(event.User, event.HWID, event.Type, event.At),
+	)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create webhook request")
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to post to %s", opts.URL)
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded %s", opts.URL, res.Status)
+	}
+	return nil
+}
+
+// parseSimulatedTime parses "15:04" on the day of now, or "2006-01-02 15:04".
+// Empty string means now.
+func parseSimulatedTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return now, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("15:04", s, time.Local)
+	if err != nil {
+		return time.Time{}, errors.Errorf("invalid time %q, expected \"15:04\" or \"2006-01-02 15:04\"", s)
+	}
+	y, m, d := now.Date()
+	return time.Date(y, m, d, t.Hour(), t.Minute(), 0, 0, time.Local), nil
+}
+
+// parseScenario parses the scenario of a day, lines are sorted by time.
+//
+//	# time user      hwid       type
+//	09:02  U0123abcd 0123456789 enter
+//	12:10  U0123abcd 0123456789 leave
+func parseScenario(r io.Reader, day time.Time) ([]*simulatedEvent, error) {
+	var events []*simulatedEvent
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			return nil, errors.Errorf("line %d: expected \"15:04 <user> <hwid> enter|leave\"", n)
+		}
+		at, err := parseSimulatedTime(fields[0], day)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", n)
+		}
+		if fields[3] != "enter" && fields[3] != "leave" {
+			return nil, errors.Errorf("line %d: type must be enter or leave, but %q", n, fields[3])
+		}
+		events = append(events, &simulatedEvent{
+			At:   at,
+			User: fields[1],
+			HWID: fields[2],
+			Type: fields[3],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "Failed to read scenario")
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].At.Before(events[j].At)
+	})
+	return events, nil
+}
@@ -6,7 +6,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"sort"
+	"sync"
+	"sync/atomic"
 
 	"go.uber.org/zap"
 
@@ -16,70 +17,157 @@ import (
 	"github.com/pkg/errors"
 )
 
+// botName is the default persona, and the prefix of redis keys
 const botName = "chihiro"
 
-func (l *labbot) msgEvent(rtm *slack.RTM, botID string, event <-chan *slack.MessageEvent) {
+// slackAdapter is ChatAdapter for slack
+type slackAdapter struct {
+	client            *slack.Client
+	verificationToken string
+	// botName is the user name of the bot, which is the name of persona
+	botName string
+	*zap.Logger
+
+	// connected is 1 while RTM is connected
+	connected int32
+
+	mu  sync.Mutex
+	rtm *slack.RTM
+}
+
+// newSlackAdapter creates slackAdapter. apiURL replaces the base url of slack web api
+// if it is not empty, e.g. the url of fake server.
+func newSlackAdapter(token, verificationToken, apiURL, botName string, logger *zap.Logger) *slackAdapter {
+	if apiURL != "" {
+		// slack package has the base url as the global variable
+		slack.SLACK_API = strings.TrimRight(apiURL, "/") + "/"
+	}
+	return &slackAdapter{
+		client:            slack.New(token),
+		verificationToken: verificationToken,
+		botName:           botName,
+		Logger:            logger,
+	}
+}
+
+func (s *slackAdapter) Name() string { return "slack" }
+
+func (s *slackAdapter) Listen(h ChatHandler) error {
+	botID, err := s.FindUserID(s.botName)
+	if err != nil {
+		s.Error("Could not to get the bot id", zap.Error(err))
+	}
+
+	rtm := s.client.NewRTM()
+	s.mu.Lock()
+	s.rtm = rtm
+	s.mu.Unlock()
+	go rtm.ManageConnection()
+
+	reply := make(chan *slack.MessageEvent)
+	defer close(reply)
+
+	go s.msgEvent(h, botID, reply)
+
+	defer atomic.StoreInt32(&s.connected, 0)
+	for msg := range rtm.IncomingEvents {
+		switch ev := msg.Data.(type) {
+		case *slack.ConnectedEvent:
+			atomic.StoreInt32(&s.connected, 1)
+		case *slack.DisconnectedEvent:
+			atomic.StoreInt32(&s.connected, 0)
+			if ev.Intentional {
+				// Disconnected by Close
+				return nil
+			}
+		case *slack.MessageEvent:
+			reply <- ev
+		case *slack.RTMError:
+			s.Error("slack rtm error", zap.String("Error", ev.Error()))
+		case *slack.InvalidAuthEvent:
+			return errors.New("Invalid credentials")
+		}
+	}
+	return nil
+}
+
+func (s *slackAdapter) msgEvent(h ChatHandler, botID string, event <-chan *slack.MessageEvent) {
 	mention := fmt.Sprintf("<@%s>", botID)
 	for ev := range event {
-		if !strings.Contains(ev.Text, mention) {
+		direct := isDirect(ev.Channel)
+		if !strings.Contains(ev.Text, mention) && !direct {
 			continue
 		}
-		// 誰がいる?
-		if strings.Contains(ev.Text, "誰がい") {
-			list := make([]string, 0, len(timeStamp))
-			for _, who := range timeStamp {
-				if who.Inlab {
-					list = append(list, who.Name)
-				}
-			}
-			sort.Strings(list)
-			rtm.SendMessage(rtm.NewOutgoingMessage("研究室には"+strings.Join(list, "、")+"がいます！", ev.Channel))
-		}
+		h.OnMention(&Mention{
+			Channel: ev.Channel,
+			User:    ev.User,
+			Text:    strings.TrimSpace(strings.Replace(ev.Text, mention, "", -1)),
+			Direct:  direct,
+		})
+	}
+}
 
-		// よし
-		if strings.Contains(ev.Text, "よし") {
-			l.sendButtonMessageToSlack(ev.Channel, ev.Text)
-		}
+// Close disconnects RTM, and Listen returns.
+func (s *slackAdapter) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rtm == nil {
+		return nil
 	}
+	return s.rtm.Disconnect()
 }
 
-// Not rtm
-func (l *labbot) sendToSlack(channel, msg string) {
-	channelID, err := l.findChannelID(channel)
-	if err != nil {
-		l.Error("Failed to find channel id", zap.Error(err))
-		return
+func (s *slackAdapter) Ping() error {
+	if _, err := s.client.AuthTest(); err != nil {
+		return errors.Wrap(err, "Failed to auth.test")
 	}
-	params := parameter()
-	_, timestamp, err := l.PostMessage(channelID, msg, params)
+	return nil
+}
+
+func (s *slackAdapter) Connected() bool {
+	return atomic.LoadInt32(&s.connected) == 1
+}
+
+// isDirect reports whether the channel is direct message
+func isDirect(channelID string) bool {
+	return strings.HasPrefix(channelID, "D")
+}
+
+func (s *slackAdapter) PostMessage(channelID string, msg *ChatMessage) error {
+	params := s.parameter()
+	if msg.Attachment != nil {
+		params.Attachments = []slack.Attachment{slackAttachment(msg.Attachment)}
+	}
+	_, timestamp, err := s.client.PostMessage(channelID, msg.Text, params)
 	if err != nil {
-		l.Warn(`Failed to post to slack`, zap.Error(err), zap.String("message", msg))
-		return
+		return err
 	}
-	l.Info(
-		"Message successfully sent to slack",
-		zap.String("channelID", channelID),
-		zap.String("timestamp", timestamp),
-	)
+	s.Debug("slack timestamp", zap.String("timestamp", timestamp))
+	return nil
 }
 
-func (l *labbot) sendButtonMessageToSlack(channelID, msg string) {
-	params := joinBtnParam(msg)
-	_, timestamp, err := l.PostMessage(channelID, "", params)
-	if err != nil {
-		l.Warn(`Failed to post button to slack`, zap.Error(err), zap.String("message", msg))
-		return
+func slackAttachment(a *ChatAttachment) slack.Attachment {
+	attachment := slack.Attachment{
+		Text:       a.Text,
+		Color:      a.Color,
+		Footer:     a.Footer,
+		CallbackID: a.CallbackID,
 	}
-	l.Info(
-		"Message successfully sent to slack",
-		zap.String("channelID", channelID),
-		zap.String("timestamp", timestamp),
-	)
+	for _, choice := range a.Choices {
+		attachment.Actions = append(attachment.Actions, slack.AttachmentAction{
+			Name:  choice.Name,
+			Text:  choice.Text,
+			Style: choice.Style,
+			Type:  "button",
+			Value: choice.Value,
+		})
+	}
+	return attachment
 }
 
-func (l *labbot) findUserID(username string) (string, error) {
+func (s *slackAdapter) FindUserID(username string) (string, error) {
 	// Get users infomation
-	users, err := l.GetUsers()
+	users, err := s.client.GetUsers()
 	if err != nil {
 		return "", errors.Wrap(err, "Failed to get slack users")
 	}
@@ -92,9 +180,9 @@ func (l *labbot) findUserID(username string) (string, error) {
 	return "", fmt.Errorf("Could not find id for %s", username)
 }
 
-func (l *labbot) findChannelID(name string) (string, error) {
+func (s *slackAdapter) FindChannelID(name string) (string, error) {
 	// Get slack channnels
-	channels, err := l.GetChannels(false)
+	channels, err := s.client.GetChannels(false)
 	if err != nil {
 		return "", errors.Wrap(err, "Failed to get slack channnel")
 	}
@@ -106,58 +194,54 @@ func (l *labbot) findChannelID(name string) (string, error) {
 	return "", fmt.Errorf("Could not find ChannelID of #%s", name)
 }
 
-func parameter() slack.PostMessageParameters {
-	return slack.PostMessageParameters{
-		Username:  botName,
-		AsUser:    true,
-		LinkNames: 1,
+func (s *slackAdapter) DirectChannelID(userID string) (string, error) {
+	_, _, channelID, err := s.client.OpenIMChannel(userID)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to open im channel")
 	}
+	return channelID, nil
 }
 
-const (
-	actionJoin    = "参加"
-	actionNotJoin = "参加しない"
-)
-
-func joinBtnParam(text string) slack.PostMessageParameters {
-	attachment := slack.Attachment{
-		Text:       text,
-		Color:      "#27ae60",
-		CallbackID: "participation",
-		Actions: []slack.AttachmentAction{
-			slack.AttachmentAction{
-				Name:  actionJoin,
-				Text:  "参加する",
-				Type:  "button",
-				Value: "join",
-			},
-			slack.AttachmentAction{
-				Name:  actionNotJoin,
-				Text:  "参加しない",
-				Style: "danger",
-				Type:  "button",
-				Value: "not join",
-			},
-		},
+func (s *slackAdapter) User(userID string) (*ChatUser, error) {
+	user, err := s.client.GetUserInfo(userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get slack user info")
 	}
+	return &ChatUser{
+		ID:          user.ID,
+		Name:        user.Name,
+		DisplayName: user.Profile.DisplayName,
+	}, nil
+}
+
+func (s *slackAdapter) RegisterHandlers(mux *http.ServeMux, h ChatHandler) {
+	mux.HandleFunc("/slack_participate", func(w http.ResponseWriter, r *http.Request) {
+		s.interactive(w, r, h)
+	})
+	mux.HandleFunc("/slack_command", func(w http.ResponseWriter, r *http.Request) {
+		s.slashCommand(w, r, h)
+	})
+}
+
+func (s *slackAdapter) parameter() slack.PostMessageParameters {
 	return slack.PostMessageParameters{
-		Username:    botName,
-		AsUser:      true,
-		LinkNames:   1,
-		Attachments: []slack.Attachment{attachment},
+		Username:  s.botName,
+		AsUser:    true,
+		LinkNames: 1,
 	}
 }
 
-func (l *labbot) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// "/slack_participate" handler for buttons
+func (s *slackAdapter) interactive(w http.ResponseWriter, r *http.Request, h ChatHandler) {
 	if r.Method != http.MethodPost {
-		l.Error("Invalid method", zap.String("method", r.Method), zap.String("expected", "POST"))
+		s.Error("Invalid method", zap.String("method", r.Method), zap.String("expected", "POST"))
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
 	buf, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		l.Error("Failed to read request body", zap.Error(err))
+		s.Error("Failed to read request body", zap.Error(err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -165,42 +249,42 @@ func (l *labbot) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	trimmed := string(buf)[8:] // trim `payload=`...
 	jsonStr, err := url.QueryUnescape(trimmed)
 	if err != nil {
-		l.Error("Failed to unespace request body", zap.Error(err))
+		s.Error("Failed to unespace request body", zap.Error(err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	l.Info("json", zap.String("json", jsonStr))
+	s.Info("json", zap.String("json", jsonStr))
 
 	var message slack.AttachmentActionCallback
 	if err := json.Unmarshal([]byte(jsonStr), &message); err != nil {
-		l.Error("Failed to decode json message from slack", zap.String("json", jsonStr))
+		s.Error("Failed to decode json message from slack", zap.String("json", jsonStr))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	// Only accept message from slack with valid token
-	if message.Token != verificationToken {
-		l.Error("Invalid token", zap.String("token", message.Token))
+	if message.Token != s.verificationToken {
+		s.Error("Invalid token", zap.String("token", message.Token))
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
 	action := message.Actions[0]
-	switch action.Name {
-	case actionJoin:
-		title := "楽しんでくださいねっ！"
-		l.responseText(w, message.OriginalMessage, title, "")
-	case actionNotJoin:
-		title := "残念です…"
-		l.responseText(w, message.OriginalMessage, title, "")
-	default:
-		l.Error("Invalid action was submitted", zap.String("action", action.Name))
+	title := h.OnChoice(&ChoiceEvent{
+		CallbackID: message.CallbackID,
+		Name:       action.Name,
+		Value:      action.Value,
+		UserID:     message.User.ID,
+	})
+	if title == "" {
 		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
+	s.responseText(w, message.OriginalMessage, title, "")
 }
 
-func (l *labbot) responseText(w http.ResponseWriter, original slack.Message, title, value string) {
+func (s *slackAdapter) responseText(w http.ResponseWriter, original slack.Message, title, value string) {
 	original.Attachments[0].Actions = []slack.AttachmentAction{} // empty buttons
 	original.Attachments[0].Fields = []slack.AttachmentField{
 		{
@@ -213,6 +297,43 @@ func (l *labbot) responseText(w http.ResponseWriter, original slack.Message, tit
 	w.WriteHeader(http.StatusOK)
 	err := json.NewEncoder(w).Encode(&original)
 	if err != nil {
-		l.Error("Failed to write json", zap.Error(err))
+		s.Error("Failed to write json", zap.Error(err))
 	}
 }
+
+// "/slack_command" handler for "/labbot in --at 09:30" etc.
+func (s *slackAdapter) slashCommand(w http.ResponseWriter, r *http.Request, h ChatHandler) {
+	if r.Method != http.MethodPost {
+		s.Error("Invalid method", zap.String("method", r.Method), zap.String("expected", "POST"))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.Error("Failed to parse form", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Only accept command from slack with valid token
+	if token := r.PostForm.Get("token"); token != s.verificationToken {
+		s.Error("Invalid token", zap.String("token", token))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	text := h.OnCommand(r.PostForm.Get("user_id"), r.PostForm.Get("text"))
+	writeCommandResponse(w, text)
+}
+
+// writeCommandResponse writes the response of slash command,
+// the format is shared by slack and mattermost.
+func writeCommandResponse(w http.ResponseWriter, text string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ResponseType string `json:"response_type"`
+		Text         string `json:"text"`
+	}{
+		ResponseType: "ephemeral",
+		Text:         text,
+	})
+}
@@ -0,0 +1,205 @@
+package labbot
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// subscriptionsKey is the hash of id and subscription
+const subscriptionsKey = key + ":subscriptions"
+
+// subscription is the request to notify the chat user when the member arrives
+type subscription struct {
+	ID     string `json:"id"`
+	UserID string `json:"user_id"`
+	// Target is the member name, or empty for anyone
+	Target string `json:"target,omitempty"`
+	// Persistent subscription notifies every arrival until it expires,
+	// otherwise it is removed after the first notification.
+	Persistent bool      `json:"persistent"`
+	Expires    time.Time `json:"expires"`
+}
+
+// subscriptionRequest is parsed "notify me when @x arrives"
+type subscriptionRequest struct {
+	// target is the mention, or empty for anyone
+	target     string
+	persistent bool
+	// duration is specified like "3日間", or zero for --notify-expiry
+	duration time.Duration
+}
+
+var (
+	notifyJaPattern     = regexp.MustCompile(`(誰か|<@[^>]+>|@\S+?)\s*(?:さん)?が?来(?:たら|るたびに?)(?:教えて|知らせて|通知して)`)
+	notifyEnPattern     = regexp.MustCompile(`(?i)notify me when (someone|anyone|<@[^>]+>|@\S+) (?:arrives|comes)`)
+	notifyCancelPattern = regexp.MustCompile(`(?i)通知(?:を)?(?:やめて|解除)|stop notifying|unsubscribe`)
+	everyPattern        = regexp.MustCompile(`(?i)毎回|いつも|来るたび|every ?time|always`)
+	durationPattern     = regexp.MustCompile(`(?i)(\d+)\s*(日間|days?|時間|hours?)`)
+)
+
+// parseSubscription parses "@x が来たら教えて", "誰か来たら教えて", "notify me when @x arrives".
+// "毎回", "every time" make it persistent, and "3日間", "for 8 hours" set the expiry.
+func parseSubscription(text string) (*subscriptionRequest, bool) {
+	var target string
+	if m := notifyJaPattern.FindStringSubmatch(text); m != nil {
+		target = m[1]
+	} else if m := notifyEnPattern.FindStringSubmatch(text); m != nil {
+		target = m[1]
+	} else {
+		return nil, false
+	}
+	switch target {
+	case "誰か", "someone", "anyone":
+		target = ""
+	}
+	req := &subscriptionRequest{
+		target:     target,
+		persistent: everyPattern.MatchString(text),
+	}
+	if m := durationPattern.FindStringSubmatch(text); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		if m[2] == "時間" || strings.HasPrefix(strings.ToLower(m[2]), "hour") {
+			req.duration = time.Duration(n) * time.Hour
+		} else {
+			req.duration = time.Duration(n) * 24 * time.Hour
+		}
+	}
+	return req, true
+}
+
+func newRandomID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func (l *labbot) storeSubscription(sub *subscription) error {
+	serialized, err := json.Marshal(sub)
+	if err != nil {
+		return errors.Wrap(err, "JSON Marshal error")
+	}
+	if err := l.Redis.HSet(subscriptionsKey, sub.ID, string(serialized)).Err(); err != nil {
+		return errors.Wrap(err, "Could not set subscription to redis")
+	}
+	return nil
+}
+
+func (l *labbot) subscriptions() ([]*subscription, error) {
+	all, err := l.Redis.HGetAll(subscriptionsKey).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get subscriptions")
+	}
+	list := make([]*subscription, 0, len(all))
+	for _, serialized := range all {
+		sub := new(subscription)
+		if err := json.Unmarshal([]byte(serialized), sub); err != nil {
+			l.Warn("Could not unmarshal subscription", zap.Error(err))
+			continue
+		}
+		list = append(list, sub)
+	}
+	return list, nil
+}
+
+// answerSubscription subscribes or unsubscribes arrivals for the chat user.
+// It returns false if the text is not the request.
+func (l *labbot) answerSubscription(userID, text string) (string, bool) {
+	if notifyCancelPattern.MatchString(text) {
+		return l.unsubscribe(userID, l.localeOfChatUser(userID)), true // locale.go
+	}
+	req, ok := parseSubscription(text)
+	if !ok {
+		return "", false
+	}
+	locale := l.localeOfChatUser(userID)
+	sub := &subscription{
+		ID:         newRandomID(),
+		UserID:     userID,
+		Persistent: req.persistent,
+	}
+	if req.target != "" {
+		name, err := l.targetName(req.target) // timequery.go
+		if err != nil {
+			l.Warn("Could not find the member", zap.String("target", req.target), zap.Error(err))
+			return l.messageIn(locale, "history.unknown-member", &messageData{}), true
+		}
+		sub.Target = name
+	}
+	duration := req.duration
+	if duration <= 0 {
+		duration = l.NotifyExpiry
+	}
+	sub.Expires = time.Now().Add(duration)
+	if err := l.storeSubscription(sub); err != nil {
+		l.Error("Failed to subscribe", zap.Error(err))
+		return l.messageIn(locale, "notify.failed", &messageData{}), true
+	}
+	data := &messageData{Name: sub.Target, Time: formatTime(locale, sub.Expires)}
+	if sub.Persistent {
+		return l.messageIn(locale, "notify.every", data), true
+	}
+	return l.messageIn(locale, "notify.once", data), true
+}
+
+// unsubscribe removes all subscriptions of the chat user.
+func (l *labbot) unsubscribe(userID, locale string) string {
+	list, err := l.subscriptions()
+	if err != nil {
+		l.Error("Failed to unsubscribe", zap.Error(err))
+		return l.messageIn(locale, "notify.failed", &messageData{})
+	}
+	for _, sub := range list {
+		if sub.UserID != userID {
+			continue
+		}
+		if err := l.Redis.HDel(subscriptionsKey, sub.ID).Err(); err != nil {
+			l.Error("Failed to unsubscribe", zap.Error(err))
+			return l.messageIn(locale, "notify.failed", &messageData{})
+		}
+	}
+	return l.messageIn(locale, "notify.cancelled", &messageData{})
+}
+
+// notifyArrival sends DM to the chat users who subscribe the arrival of the member.
+// Expired subscriptions are removed here.
+func (l *labbot) notifyArrival(name, room string, at time.Time) {
+	list, err := l.subscriptions()
+	if err != nil {
+		l.Error("Failed to notify arrival", zap.Error(err))
+		return
+	}
+	now := time.Now()
+	for _, sub := range list {
+		if now.After(sub.Expires) {
+			l.Redis.HDel(subscriptionsKey, sub.ID)
+			continue
+		}
+		if sub.Target != "" && sub.Target != name {
+			continue
+		}
+		// Nobody wants to know that they arrived
+		if sub.Target == "" {
+			if self, err := l.memberName(sub.UserID); err == nil && self == name { // checkin.go
+				continue
+			}
+		}
+		if !sub.Persistent {
+			// Only one who removes it notifies, in case of concurrent arrivals
+			n, err := l.Redis.HDel(subscriptionsKey, sub.ID).Result()
+			if err != nil || n == 0 {
+				continue
+			}
+		}
+		locale := l.localeOfChatUser(sub.UserID)
+		text := l.messageIn(locale, "notify.arrived", &messageData{Name: name, Room: room, Time: formatTime(locale, at)})
+		l.sendDirectMessage(sub.UserID, &ChatMessage{Text: text})
+	}
+}
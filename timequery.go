@@ -0,0 +1,347 @@
+package labbot
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// queryKind is the kind of question about the attendance history
+type queryKind int
+
+const (
+	queryWhoAt    queryKind = iota // 昨日の15時に誰がいた?
+	queryWhoOn                     // who was here on 2026-10-01
+	queryWhenLeft                  // when did @x leave yesterday
+	queryWhenCame                  // @x は昨日いつ来た?
+)
+
+// timeQuery is the question which is parsed by parseTimeQuery
+type timeQuery struct {
+	kind queryKind
+	// day is 00:00 of the day in question
+	day time.Time
+	// at is the moment in question of queryWhoAt
+	at time.Time
+	// target is the mention in the text, e.g. "<@U0123>" or "@name"
+	target string
+}
+
+var (
+	whoPattern    = regexp.MustCompile(`誰|だれ|\bwho\b`)
+	whenPattern   = regexp.MustCompile(`いつ|何時|\bwhen\b|\bwhat time\b`)
+	leftPattern   = regexp.MustCompile(`帰った|帰りました|帰ってた|\bleft\b|\bleave\b`)
+	camePattern   = regexp.MustCompile(`来た|来ました|着いた|\bcame\b|\bcome\b|\barrived?\b`)
+	targetPattern = regexp.MustCompile(`<@[A-Za-z0-9]+(\|[^>]*)?>|@[^\s@、。?？!！はがのを]+`)
+)
+
+// parseTimeQuery parses the question like "昨日の15時に誰がいた?", "who was here on 2026-10-01",
+// "when did @x leave yesterday". It returns false if the text is not the question.
+// The question about who without any date or time is answered by peopleInLab.
+func parseTimeQuery(text string, now time.Time) (*timeQuery, bool) {
+	lower := strings.ToLower(text)
+	day, hasDate := parseDateExpr(lower, now)
+	if !hasDate {
+		y, m, d := now.Date()
+		day = time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	}
+	at, hasTime := parseTimeExpr(lower, day, now)
+
+	if whenPattern.MatchString(lower) {
+		target := targetPattern.FindString(text)
+		if target == "" {
+			return nil, false
+		}
+		switch {
+		case leftPattern.MatchString(lower):
+			return &timeQuery{kind: queryWhenLeft, day: day, target: target}, true
+		case camePattern.MatchString(lower):
+			return &timeQuery{kind: queryWhenCame, day: day, target: target}, true
+		}
+		return nil, false
+	}
+	if !whoPattern.MatchString(lower) {
+		return nil, false
+	}
+	switch {
+	case hasTime:
+		y, m, d := at.Date()
+		return &timeQuery{kind: queryWhoAt, day: time.Date(y, m, d, 0, 0, 0, 0, at.Location()), at: at}, true
+	case hasDate:
+		return &timeQuery{kind: queryWhoOn, day: day}, true
+	}
+	return nil, false
+}
+
+var (
+	isoDatePattern    = regexp.MustCompile(`(\d{4})[-/](\d{1,2})[-/](\d{1,2})`)
+	jaDatePattern     = regexp.MustCompile(`(\d{1,2})月(\d{1,2})日`)
+	slashDatePattern  = regexp.MustCompile(`(?:^|[^\d/])(\d{1,2})/(\d{1,2})(?:$|[^\d/])`)
+	daysAgoPattern    = regexp.MustCompile(`(\d+)\s*(?:日前|days? ago)`)
+	jaLastWeekPattern = regexp.MustCompile(`先週の?([月火水木金土日])曜`)
+	jaWeekdayPattern  = regexp.MustCompile(`([月火水木金土日])曜`)
+	enWeekdayPattern  = regexp.MustCompile(`\b(last |on )?(sunday|monday|tuesday|wednesday|thursday|friday|saturday)\b`)
+)
+
+var jaWeekdays = map[string]time.Weekday{
+	"日": time.Sunday, "月": time.Monday, "火": time.Tuesday, "水": time.Wednesday,
+	"木": time.Thursday, "金": time.Friday, "土": time.Saturday,
+}
+
+var enWeekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday, "wednesday": time.Wednesday,
+	"thursday": time.Thursday, "friday": time.Friday, "saturday": time.Saturday,
+}
+
+// parseDateExpr finds the date in lower cased text, and returns 00:00 of the day.
+// Dates without the year are in the past year if they are after now.
+func parseDateExpr(text string, now time.Time) (time.Time, bool) {
+	y, m, d := now.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	date := func(year, month, day int) time.Time {
+		return time.Date(year, time.Month(month), day, 0, 0, 0, 0, now.Location())
+	}
+	monthDay := func(month, day int) time.Time {
+		t := date(y, month, day)
+		if t.After(today) {
+			t = date(y-1, month, day)
+		}
+		return t
+	}
+
+	if m := isoDatePattern.FindStringSubmatch(text); m != nil {
+		return date(atoi(m[1]), atoi(m[2]), atoi(m[3])), true
+	}
+	if m := jaDatePattern.FindStringSubmatch(text); m != nil {
+		return monthDay(atoi(m[1]), atoi(m[2])), true
+	}
+	if m := slashDatePattern.FindStringSubmatch(text); m != nil {
+		return monthDay(atoi(m[1]), atoi(m[2])), true
+	}
+	if m := daysAgoPattern.FindStringSubmatch(text); m != nil {
+		return today.AddDate(0, 0, -atoi(m[1])), true
+	}
+	// 一昨日 contains 昨日
+	switch {
+	case strings.Contains(text, "一昨日"), strings.Contains(text, "おととい"), strings.Contains(text, "day before yesterday"):
+		return today.AddDate(0, 0, -2), true
+	case strings.Contains(text, "昨日"), strings.Contains(text, "きのう"), strings.Contains(text, "yesterday"):
+		return today.AddDate(0, 0, -1), true
+	case strings.Contains(text, "今日"), strings.Contains(text, "きょう"), strings.Contains(text, "today"):
+		return today, true
+	}
+	if m := jaLastWeekPattern.FindStringSubmatch(text); m != nil {
+		// the weekday of the previous week, weeks begin on monday
+		monday := beginningOfWeek(today).AddDate(0, 0, -7) // history.go
+		return monday.AddDate(0, 0, (int(jaWeekdays[m[1]])+6)%7), true
+	}
+	if m := jaWeekdayPattern.FindStringSubmatch(text); m != nil {
+		return lastWeekday(today, jaWeekdays[m[1]], false), true
+	}
+	if m := enWeekdayPattern.FindStringSubmatch(text); m != nil {
+		return lastWeekday(today, enWeekdays[m[2]], m[1] == "last "), true
+	}
+	return time.Time{}, false
+}
+
+// lastWeekday returns the latest weekday until today, or before today if strict.
+func lastWeekday(today time.Time, weekday time.Weekday, strict bool) time.Time {
+	days := (int(today.Weekday()) - int(weekday) + 7) % 7
+	if days == 0 && strict {
+		days = 7
+	}
+	return today.AddDate(0, 0, -days)
+}
+
+var (
+	hoursAgoPattern = regexp.MustCompile(`(\d+)\s*(?:時間前|hours? ago)`)
+	clockPattern    = regexp.MustCompile(`(\d{1,2}):(\d{2})\s*(am|pm)?`)
+	enHourPattern   = regexp.MustCompile(`\b(\d{1,2})\s*(am|pm)\b`)
+	jaHourPattern   = regexp.MustCompile(`(午前|午後)?(\d{1,2})時(半|(\d{1,2})分)?`)
+)
+
+// parseTimeExpr finds the time of day in lower cased text, and returns the moment on the day.
+// The moment which is relative to now, e.g. "2時間前", ignores the day.
+func parseTimeExpr(text string, day, now time.Time) (time.Time, bool) {
+	// "2時間前" contains "2時"
+	if m := hoursAgoPattern.FindStringSubmatch(text); m != nil {
+		return now.Add(-time.Duration(atoi(m[1])) * time.Hour), true
+	}
+	hour, min := -1, 0
+	if m := clockPattern.FindStringSubmatch(text); m != nil {
+		hour, min = to24Hour(atoi(m[1]), m[3]), atoi(m[2])
+	} else if m := enHourPattern.FindStringSubmatch(text); m != nil {
+		hour = to24Hour(atoi(m[1]), m[2])
+	} else if m := jaHourPattern.FindStringSubmatch(text); m != nil {
+		hour = atoi(m[2])
+		if m[1] == "午後" && hour < 12 {
+			hour += 12
+		}
+		if m[3] == "半" {
+			min = 30
+		} else if m[4] != "" {
+			min = atoi(m[4])
+		}
+	}
+	if hour < 0 || hour > 23 || min > 59 {
+		return time.Time{}, false
+	}
+	y, m, d := day.Date()
+	return time.Date(y, m, d, hour, min, 0, 0, day.Location()), true
+}
+
+func to24Hour(hour int, ampm string) int {
+	switch {
+	case ampm == "pm" && hour < 12:
+		return hour + 12
+	case ampm == "am" && hour == 12:
+		return 0
+	}
+	return hour
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// presentAt returns names of people who were in the lab at the moment.
+// Like expire in line-beacon.go, people who haven't updated for 24 hours are not counted.
+func presentAt(records []*Record, at time.Time) []string {
+	last := make(map[string]*Record)
+	for _, rec := range records {
+		if rec.Time.After(at) {
+			break
+		}
+		last[rec.Name] = rec
+	}
+	names := make([]string, 0, len(last))
+	for name, rec := range last {
+		if rec.Inlab && at.Sub(rec.Time) <= 24*time.Hour {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// presentOn returns names of people who were in the lab on the day.
+func presentOn(records []*Record, day time.Time) []string {
+	end := day.AddDate(0, 0, 1)
+	seen := make(map[string]bool)
+	for _, name := range presentAt(records, day) {
+		seen[name] = true
+	}
+	for _, rec := range records {
+		if rec.Inlab && !rec.Time.Before(day) && rec.Time.Before(end) {
+			seen[rec.Name] = true
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// timesOn returns times when the person came, or left, on the day.
+// Moving between rooms is not counted.
+func timesOn(records []*Record, name string, day time.Time, inlab bool) []time.Time {
+	end := day.AddDate(0, 0, 1)
+	var times []time.Time
+	for _, rec := range records {
+		if rec.Name != name || rec.From != "" || rec.Inlab != inlab {
+			continue
+		}
+		if !rec.Time.Before(day) && rec.Time.Before(end) {
+			times = append(times, rec.Time)
+		}
+	}
+	return times
+}
+
+// answerTimeQuery answers the question about the attendance history.
+// It returns false if the text is not the question.
+func (l *labbot) answerTimeQuery(req *commandRequest) (string, bool) {
+	query, ok := parseTimeQuery(req.Text, time.Now())
+	if !ok {
+		return "", false
+	}
+	locale := l.localeOfRequest(req) // locale.go
+
+	// Records of the previous day are needed for people who stayed overnight
+	records, err := l.history(query.day.AddDate(0, 0, -1)) // history.go
+	if err != nil {
+		l.Error("Could not get history", zap.Error(err))
+		return l.messageIn(locale, "history.failed", &messageData{}), true
+	}
+
+	switch query.kind {
+	case queryWhoAt:
+		data := &messageData{Time: formatTime(locale, query.at)}
+		names := presentAt(records, query.at)
+		if len(names) == 0 {
+			return l.messageIn(locale, "history.nobody-at", data), true
+		}
+		data.Names = strings.Join(names, listSeparator(locale))
+		return l.messageIn(locale, "history.who-at", data), true
+	case queryWhoOn:
+		data := &messageData{Time: formatDate(locale, query.day)}
+		names := presentOn(records, query.day)
+		if len(names) == 0 {
+			return l.messageIn(locale, "history.nobody-on", data), true
+		}
+		data.Names = strings.Join(names, listSeparator(locale))
+		return l.messageIn(locale, "history.who-on", data), true
+	}
+
+	name, err := l.targetName(query.target)
+	if err != nil {
+		l.Warn("Could not find the member", zap.String("target", query.target), zap.Error(err))
+		return l.messageIn(locale, "history.unknown-member", &messageData{}), true
+	}
+	came := query.kind == queryWhenCame
+	times := timesOn(records, name, query.day, came)
+	data := &messageData{Name: name, Time: formatDate(locale, query.day)}
+	if len(times) == 0 {
+		if came {
+			return l.messageIn(locale, "history.not-came", data), true
+		}
+		return l.messageIn(locale, "history.not-left", data), true
+	}
+	clocks := make([]string, 0, len(times))
+	for _, t := range times {
+		clocks = append(clocks, t.Format("15:04"))
+	}
+	data.Time = strings.Join(clocks, listSeparator(locale))
+	if came {
+		return l.messageIn(locale, "history.came", data), true
+	}
+	return l.messageIn(locale, "history.left", data), true
+}
+
+// targetName returns the member name of the mention like "<@U0123>" or "@name".
+// "@name" which is not a chat user is taken as the member name, e.g. on LINE.
+func (l *labbot) targetName(target string) (string, error) {
+	if strings.HasPrefix(target, "<@") {
+		userID := strings.TrimPrefix(strings.TrimSuffix(target, ">"), "<@")
+		if i := strings.Index(userID, "|"); i >= 0 {
+			userID = userID[:i]
+		}
+		return l.memberName(userID) // checkin.go
+	}
+	name := strings.TrimPrefix(target, "@")
+	if l.Chat == nil {
+		return name, nil
+	}
+	userID, err := l.Chat.FindUserID(name)
+	if err != nil {
+		return name, nil
+	}
+	return l.memberName(userID)
+}
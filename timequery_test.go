@@ -0,0 +1,243 @@
+package labbot
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var jst = time.FixedZone("JST", 9*60*60)
+
+// queryNow is Wednesday, 2026-10-21 10:00
+var queryNow = time.Date(2026, 10, 21, 10, 0, 0, 0, jst)
+
+func queryDay(month time.Month, d int) time.Time {
+	return time.Date(2026, month, d, 0, 0, 0, 0, jst)
+}
+
+func queryTime(month time.Month, d, hour, min int) time.Time {
+	return time.Date(2026, month, d, hour, min, 0, 0, jst)
+}
+
+func TestParseTimeQuery(t *testing.T) {
+	tests := []struct {
+		text string
+		want *timeQuery
+	}{
+		{"昨日の15時に誰がいた?", &timeQuery{kind: queryWhoAt, day: queryDay(10, 20), at: queryTime(10, 20, 15, 0)}},
+		{"一昨日は誰がいた?", &timeQuery{kind: queryWhoOn, day: queryDay(10, 19)}},
+		{"先週の金曜は誰が来てた?", &timeQuery{kind: queryWhoOn, day: queryDay(10, 16)}},
+		{"who was here on 2026-10-01", &timeQuery{kind: queryWhoOn, day: queryDay(10, 1)}},
+		{"10/1に誰がいた?", &timeQuery{kind: queryWhoOn, day: queryDay(10, 1)}},
+		{"who was here at 3pm", &timeQuery{kind: queryWhoAt, day: queryDay(10, 21), at: queryTime(10, 21, 15, 0)}},
+		{"2時間前に誰がいた?", &timeQuery{kind: queryWhoAt, day: queryDay(10, 21), at: queryTime(10, 21, 8, 0)}},
+		{"10時間前に誰がいた?", &timeQuery{kind: queryWhoAt, day: queryDay(10, 21), at: queryTime(10, 21, 0, 0)}},
+		{"11時間前に誰がいた?", &timeQuery{kind: queryWhoAt, day: queryDay(10, 20), at: queryTime(10, 20, 23, 0)}},
+		{"@alice は昨日いつ来た?", &timeQuery{kind: queryWhenCame, day: queryDay(10, 20), target: "@alice"}},
+		{"when did <@U0123> leave yesterday", &timeQuery{kind: queryWhenLeft, day: queryDay(10, 20), target: "<@U0123>"}},
+		{"<@U0123|alice> は何時に帰った?", &timeQuery{kind: queryWhenLeft, day: queryDay(10, 21), target: "<@U0123|alice>"}},
+
+		// Not the question
+		{"おはよう", nil},
+		{"誰かいる?", nil}, // answered by peopleInLab
+		{"いつ来た?", nil},
+		{"15時から会議です", nil},
+		{"when is the seminar?", nil},
+		{"@alice いつ空いてる?", nil},
+	}
+	for _, tt := range tests {
+		got, ok := parseTimeQuery(tt.text, queryNow)
+		if tt.want == nil {
+			if ok {
+				t.Errorf("parseTimeQuery(%q) = %+v, want not the question", tt.text, got)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("parseTimeQuery(%q) is not the question", tt.text)
+			continue
+		}
+		if got.kind != tt.want.kind || !got.day.Equal(tt.want.day) || !got.at.Equal(tt.want.at) || got.target != tt.want.target {
+			t.Errorf("parseTimeQuery(%q) = %+v, want %+v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestParseDateExpr(t *testing.T) {
+	tests := []struct {
+		text string
+		want time.Time
+	}{
+		{"2026-10-01", queryDay(10, 1)},
+		{"2025/12/31", time.Date(2025, 12, 31, 0, 0, 0, 0, jst)},
+		{"10/1", queryDay(10, 1)},
+		{"10月1日", queryDay(10, 1)},
+		{"10/21", queryDay(10, 21)},
+		// Dates after today are in the last year
+		{"12/25", time.Date(2025, 12, 25, 0, 0, 0, 0, jst)},
+		{"10月22日", time.Date(2025, 10, 22, 0, 0, 0, 0, jst)},
+		{"3日前", queryDay(10, 18)},
+		{"3 days ago", queryDay(10, 18)},
+		{"今日", queryDay(10, 21)},
+		{"today", queryDay(10, 21)},
+		{"昨日", queryDay(10, 20)},
+		{"yesterday", queryDay(10, 20)},
+		{"一昨日", queryDay(10, 19)},
+		{"おととい", queryDay(10, 19)},
+		{"the day before yesterday", queryDay(10, 19)},
+		{"先週の金曜", queryDay(10, 16)},
+		{"先週の月曜", queryDay(10, 12)},
+		{"先週の日曜", queryDay(10, 18)},
+		{"金曜", queryDay(10, 16)},
+		{"水曜", queryDay(10, 21)},
+		{"on monday", queryDay(10, 19)},
+		{"on wednesday", queryDay(10, 21)},
+		{"last wednesday", queryDay(10, 14)},
+	}
+	for _, tt := range tests {
+		got, ok := parseDateExpr(tt.text, queryNow)
+		if !ok || !got.Equal(tt.want) {
+			t.Errorf("parseDateExpr(%q) = %v, %v, want %v", tt.text, got, ok, tt.want)
+		}
+	}
+
+	for _, text := range []string{"", "15時", "3pm", "12:30", "room 10"} {
+		if got, ok := parseDateExpr(text, queryNow); ok {
+			t.Errorf("parseDateExpr(%q) = %v, want no date", text, got)
+		}
+	}
+}
+
+func TestParseDateExprYearRollover(t *testing.T) {
+	newYear := time.Date(2027, 1, 2, 10, 0, 0, 0, jst)
+	tests := []struct {
+		text string
+		want time.Time
+	}{
+		{"12/31", time.Date(2026, 12, 31, 0, 0, 0, 0, jst)},
+		{"12月31日", time.Date(2026, 12, 31, 0, 0, 0, 0, jst)},
+		{"1/2", time.Date(2027, 1, 2, 0, 0, 0, 0, jst)},
+		{"1/3", time.Date(2026, 1, 3, 0, 0, 0, 0, jst)},
+		{"昨日", time.Date(2027, 1, 1, 0, 0, 0, 0, jst)},
+		{"3日前", time.Date(2026, 12, 30, 0, 0, 0, 0, jst)},
+		{"先週の金曜", time.Date(2026, 12, 25, 0, 0, 0, 0, jst)},
+	}
+	for _, tt := range tests {
+		got, ok := parseDateExpr(tt.text, newYear)
+		if !ok || !got.Equal(tt.want) {
+			t.Errorf("parseDateExpr(%q) = %v, %v, want %v", tt.text, got, ok, tt.want)
+		}
+	}
+}
+
+func TestParseTimeExpr(t *testing.T) {
+	yesterday := queryDay(10, 20)
+	tests := []struct {
+		text string
+		want time.Time
+	}{
+		{"15時", queryTime(10, 20, 15, 0)},
+		{"9時半", queryTime(10, 20, 9, 30)},
+		{"9時15分", queryTime(10, 20, 9, 15)},
+		{"午後3時", queryTime(10, 20, 15, 0)},
+		{"午前0時", queryTime(10, 20, 0, 0)},
+		{"3pm", queryTime(10, 20, 15, 0)},
+		{"12am", queryTime(10, 20, 0, 0)},
+		{"12pm", queryTime(10, 20, 12, 0)},
+		{"at 10:30", queryTime(10, 20, 10, 30)},
+		{"at 10:30 pm", queryTime(10, 20, 22, 30)},
+		// Relative to now, not the day
+		{"2時間前", queryTime(10, 21, 8, 0)},
+		{"2 hours ago", queryTime(10, 21, 8, 0)},
+	}
+	for _, tt := range tests {
+		got, ok := parseTimeExpr(tt.text, yesterday, queryNow)
+		if !ok || !got.Equal(tt.want) {
+			t.Errorf("parseTimeExpr(%q) = %v, %v, want %v", tt.text, got, ok, tt.want)
+		}
+	}
+
+	for _, text := range []string{"", "昨日", "25時", "10:75", "2026-10-01"} {
+		if got, ok := parseTimeExpr(text, yesterday, queryNow); ok {
+			t.Errorf("parseTimeExpr(%q) = %v, want no time", text, got)
+		}
+	}
+}
+
+// testRecords is the history from 10/19 to 10/20, carol stayed overnight.
+var testRecords = []*Record{
+	{Name: "carol", Inlab: true, Room: "実験室", Time: queryTime(10, 19, 20, 0)},
+	{Name: "alice", Inlab: true, Room: "実験室", Time: queryTime(10, 20, 9, 0)},
+	{Name: "bob", Inlab: true, Room: "実験室", Time: queryTime(10, 20, 10, 0)},
+	{Name: "alice", Inlab: true, Room: "ゼミ室", From: "実験室", Time: queryTime(10, 20, 13, 0)},
+	{Name: "carol", Inlab: false, Room: "実験室", Time: queryTime(10, 20, 14, 0)},
+	{Name: "bob", Inlab: false, Room: "実験室", Time: queryTime(10, 20, 15, 0)},
+	{Name: "bob", Inlab: true, Room: "実験室", Time: queryTime(10, 20, 16, 0)},
+	{Name: "alice", Inlab: false, Room: "ゼミ室", Time: queryTime(10, 20, 18, 0)},
+	{Name: "bob", Inlab: false, Room: "実験室", Time: queryTime(10, 20, 19, 0)},
+}
+
+func TestPresentAt(t *testing.T) {
+	tests := []struct {
+		at   time.Time
+		want []string
+	}{
+		{queryTime(10, 19, 12, 0), []string{}},
+		{queryTime(10, 20, 9, 0), []string{"alice", "carol"}},
+		{queryTime(10, 20, 13, 30), []string{"alice", "bob", "carol"}},
+		{queryTime(10, 20, 15, 30), []string{"alice"}},
+		{queryTime(10, 20, 17, 0), []string{"alice", "bob"}},
+		{queryTime(10, 20, 20, 0), []string{}},
+	}
+	for _, tt := range tests {
+		if got := presentAt(testRecords, tt.at); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("presentAt(%v) = %v, want %v", tt.at, got, tt.want)
+		}
+	}
+
+	// People who haven't updated for 24 hours are expired
+	expired := []*Record{{Name: "dave", Inlab: true, Time: queryTime(10, 18, 9, 0)}}
+	if got := presentAt(expired, queryTime(10, 19, 10, 0)); len(got) != 0 {
+		t.Errorf("presentAt() of expired = %v, want nobody", got)
+	}
+}
+
+func TestPresentOn(t *testing.T) {
+	tests := []struct {
+		day  time.Time
+		want []string
+	}{
+		{queryDay(10, 19), []string{"carol"}},
+		// carol is in the lab at 00:00
+		{queryDay(10, 20), []string{"alice", "bob", "carol"}},
+		{queryDay(10, 21), []string{}},
+	}
+	for _, tt := range tests {
+		if got := presentOn(testRecords, tt.day); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("presentOn(%v) = %v, want %v", tt.day, got, tt.want)
+		}
+	}
+}
+
+func TestTimesOn(t *testing.T) {
+	tests := []struct {
+		name  string
+		day   time.Time
+		inlab bool
+		want  []time.Time
+	}{
+		// Moving to ゼミ室 is not counted
+		{"alice", queryDay(10, 20), true, []time.Time{queryTime(10, 20, 9, 0)}},
+		{"alice", queryDay(10, 20), false, []time.Time{queryTime(10, 20, 18, 0)}},
+		{"bob", queryDay(10, 20), true, []time.Time{queryTime(10, 20, 10, 0), queryTime(10, 20, 16, 0)}},
+		{"bob", queryDay(10, 20), false, []time.Time{queryTime(10, 20, 15, 0), queryTime(10, 20, 19, 0)}},
+		{"carol", queryDay(10, 20), true, nil},
+		{"carol", queryDay(10, 19), true, []time.Time{queryTime(10, 19, 20, 0)}},
+		{"alice", queryDay(10, 21), true, nil},
+	}
+	for _, tt := range tests {
+		if got := timesOn(testRecords, tt.name, tt.day, tt.inlab); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("timesOn(%s, %v, %v) = %v, want %v", tt.name, tt.day, tt.inlab, got, tt.want)
+		}
+	}
+}